@@ -16,6 +16,40 @@ type AgentConfiguration struct {
 	GitFetchFlags              string
 	GitSubmodules              bool
 	SSHKeyscan                 bool
+	SSHKnownHostsPath          string
+	SSHKnownHostsHash          bool
+	SSHKnownHostsDryRun        bool
+	SSHKnownHostsStrictModes   bool
+	SSHKeyscanAttempts         int
+	SSHKeyscanRetryInterval    int
+	SSHKeyscanKeyTypes         []string
+	SSHKeyscanCommand          string
+	SSHKeyscanConcurrency      int
+	SSHKeyscanProxy            string
+	SSHKnownHostsLockTimeout   int
+	SSHKnownHostsLockDir       string
+	SSHKnownHostsFingerprints  []string
+	SSHKnownHostsTTL           int
+	SSHKnownHostsAuditLog      string
+	SSHKnownHostsSeed          string
+	SSHKnownHostsLockFailFast  bool
+	SSHKnownHostsAllow         []string
+	SSHKnownHostsDeny          []string
+	SSHKnownHostsCertAuthority []string
+	SSHStrictHostKeyChecking   string
+	SSHKnownHostsJobScoped     bool
+	SSHKnownHostsVerify        bool
+	SSHKeyscanConnectTimeout   int
+	SSHKnownHostsFsync         bool
+	TraceCommands              bool
+	SSHToolWrapper             string
+	ColorMode                  string
+	SSHKeyscanHostKeyTypes     []string
+	SSHKeyscanMissingKeyTypes  bool
+	SSHKnownHostsReadOnly      bool
+	SSHKnownHostsIPs           string
+	SSHKnownHostsSystem        bool
+	SSHKnownHostsWarnLines     int
 	CommandEval                bool
 	PluginsEnabled             bool
 	PluginValidation           bool
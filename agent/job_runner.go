@@ -225,6 +225,10 @@ func NewJobRunner(l logger.Logger, scope *metrics.Scope, ag *api.AgentRegisterRe
 		Stdout:          processWriter,
 		Stderr:          processWriter,
 		InterruptSignal: conf.CancelSignal,
+
+		// A bootstrap left running after the agent has crashed can't report
+		// its job, so it's killed along with the agent
+		KillOnParentExit: true,
 	})
 
 	// Close the writer end of the pipe when the process finishes
@@ -459,7 +463,41 @@ func (r *JobRunner) createEnvironment() ([]string, error) {
 		`BUILDKITE_GIT_MIRRORS_PATH`,
 		`BUILDKITE_HOOKS_PATH`,
 		`BUILDKITE_PLUGINS_PATH`,
+		`BUILDKITE_SSH_KEYSCAN_CONNECT_TIMEOUT`,
+		`BUILDKITE_SSH_KEYSCAN_HOST_KEY_TYPES`,
+		`BUILDKITE_SSH_KEYSCAN_MISSING_KEY_TYPES`,
 		`BUILDKITE_SSH_KEYSCAN`,
+		`BUILDKITE_SSH_KEYSCAN_ATTEMPTS`,
+		`BUILDKITE_SSH_KEYSCAN_COMMAND`,
+		`BUILDKITE_SSH_KEYSCAN_CONCURRENCY`,
+		`BUILDKITE_SSH_KEYSCAN_KEY_TYPES`,
+		`BUILDKITE_SSH_KEYSCAN_PROXY`,
+		`BUILDKITE_SSH_KEYSCAN_RETRY_INTERVAL`,
+		`BUILDKITE_SSH_KNOWN_HOSTS_ALLOW`,
+		`BUILDKITE_SSH_KNOWN_HOSTS_AUDIT_LOG`,
+		`BUILDKITE_SSH_KNOWN_HOSTS_CERT_AUTHORITY`,
+		`BUILDKITE_SSH_KNOWN_HOSTS_DENY`,
+		`BUILDKITE_SSH_KNOWN_HOSTS_DRY_RUN`,
+		`BUILDKITE_SSH_KNOWN_HOSTS_FINGERPRINTS`,
+		`BUILDKITE_SSH_KNOWN_HOSTS_FSYNC`,
+		`BUILDKITE_SSH_KNOWN_HOSTS_HASH`,
+		`BUILDKITE_SSH_KNOWN_HOSTS_IPS`,
+		`BUILDKITE_SSH_KNOWN_HOSTS_JOB_SCOPED`,
+		`BUILDKITE_SSH_KNOWN_HOSTS_LOCK_DIR`,
+		`BUILDKITE_SSH_KNOWN_HOSTS_LOCK_FAIL_FAST`,
+		`BUILDKITE_SSH_KNOWN_HOSTS_LOCK_TIMEOUT`,
+		`BUILDKITE_SSH_KNOWN_HOSTS_PATH`,
+		`BUILDKITE_SSH_KNOWN_HOSTS_READ_ONLY`,
+		`BUILDKITE_SSH_KNOWN_HOSTS_SEED`,
+		`BUILDKITE_SSH_KNOWN_HOSTS_STRICT_MODES`,
+		`BUILDKITE_SSH_KNOWN_HOSTS_SYSTEM`,
+		`BUILDKITE_SSH_KNOWN_HOSTS_TTL`,
+		`BUILDKITE_SSH_KNOWN_HOSTS_VERIFY`,
+		`BUILDKITE_SSH_KNOWN_HOSTS_WARN_LINES`,
+		`BUILDKITE_SSH_STRICT_HOST_KEY_CHECKING`,
+		`BUILDKITE_SSH_TOOL_WRAPPER`,
+		`BUILDKITE_TRACE_COMMANDS`,
+		`BUILDKITE_COLOR_MODE`,
 		`BUILDKITE_GIT_SUBMODULES`,
 		`BUILDKITE_COMMAND_EVAL`,
 		`BUILDKITE_PLUGINS_ENABLED`,
@@ -515,6 +553,40 @@ func (r *JobRunner) createEnvironment() ([]string, error) {
 	env["BUILDKITE_HOOKS_PATH"] = r.conf.AgentConfiguration.HooksPath
 	env["BUILDKITE_PLUGINS_PATH"] = r.conf.AgentConfiguration.PluginsPath
 	env["BUILDKITE_SSH_KEYSCAN"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.SSHKeyscan)
+	env["BUILDKITE_SSH_KNOWN_HOSTS_PATH"] = r.conf.AgentConfiguration.SSHKnownHostsPath
+	env["BUILDKITE_SSH_KNOWN_HOSTS_HASH"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.SSHKnownHostsHash)
+	env["BUILDKITE_SSH_KNOWN_HOSTS_DRY_RUN"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.SSHKnownHostsDryRun)
+	env["BUILDKITE_SSH_KNOWN_HOSTS_STRICT_MODES"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.SSHKnownHostsStrictModes)
+	env["BUILDKITE_SSH_KEYSCAN_ATTEMPTS"] = fmt.Sprintf("%d", r.conf.AgentConfiguration.SSHKeyscanAttempts)
+	env["BUILDKITE_SSH_KEYSCAN_RETRY_INTERVAL"] = fmt.Sprintf("%d", r.conf.AgentConfiguration.SSHKeyscanRetryInterval)
+	env["BUILDKITE_SSH_KEYSCAN_KEY_TYPES"] = strings.Join(r.conf.AgentConfiguration.SSHKeyscanKeyTypes, ",")
+	env["BUILDKITE_SSH_KEYSCAN_COMMAND"] = r.conf.AgentConfiguration.SSHKeyscanCommand
+	env["BUILDKITE_SSH_KEYSCAN_CONCURRENCY"] = fmt.Sprintf("%d", r.conf.AgentConfiguration.SSHKeyscanConcurrency)
+	env["BUILDKITE_SSH_KEYSCAN_PROXY"] = r.conf.AgentConfiguration.SSHKeyscanProxy
+	env["BUILDKITE_SSH_KNOWN_HOSTS_LOCK_TIMEOUT"] = fmt.Sprintf("%d", r.conf.AgentConfiguration.SSHKnownHostsLockTimeout)
+	env["BUILDKITE_SSH_KNOWN_HOSTS_LOCK_DIR"] = r.conf.AgentConfiguration.SSHKnownHostsLockDir
+	env["BUILDKITE_SSH_KNOWN_HOSTS_FINGERPRINTS"] = strings.Join(r.conf.AgentConfiguration.SSHKnownHostsFingerprints, ",")
+	env["BUILDKITE_SSH_KNOWN_HOSTS_TTL"] = fmt.Sprintf("%d", r.conf.AgentConfiguration.SSHKnownHostsTTL)
+	env["BUILDKITE_SSH_KNOWN_HOSTS_AUDIT_LOG"] = r.conf.AgentConfiguration.SSHKnownHostsAuditLog
+	env["BUILDKITE_SSH_KNOWN_HOSTS_SEED"] = r.conf.AgentConfiguration.SSHKnownHostsSeed
+	env["BUILDKITE_SSH_KNOWN_HOSTS_LOCK_FAIL_FAST"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.SSHKnownHostsLockFailFast)
+	env["BUILDKITE_SSH_KNOWN_HOSTS_ALLOW"] = strings.Join(r.conf.AgentConfiguration.SSHKnownHostsAllow, ",")
+	env["BUILDKITE_SSH_KNOWN_HOSTS_DENY"] = strings.Join(r.conf.AgentConfiguration.SSHKnownHostsDeny, ",")
+	env["BUILDKITE_SSH_KNOWN_HOSTS_CERT_AUTHORITY"] = strings.Join(r.conf.AgentConfiguration.SSHKnownHostsCertAuthority, ",")
+	env["BUILDKITE_SSH_STRICT_HOST_KEY_CHECKING"] = r.conf.AgentConfiguration.SSHStrictHostKeyChecking
+	env["BUILDKITE_SSH_KNOWN_HOSTS_JOB_SCOPED"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.SSHKnownHostsJobScoped)
+	env["BUILDKITE_SSH_KNOWN_HOSTS_VERIFY"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.SSHKnownHostsVerify)
+	env["BUILDKITE_SSH_KEYSCAN_CONNECT_TIMEOUT"] = fmt.Sprintf("%d", r.conf.AgentConfiguration.SSHKeyscanConnectTimeout)
+	env["BUILDKITE_SSH_KNOWN_HOSTS_FSYNC"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.SSHKnownHostsFsync)
+	env["BUILDKITE_TRACE_COMMANDS"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.TraceCommands)
+	env["BUILDKITE_SSH_TOOL_WRAPPER"] = r.conf.AgentConfiguration.SSHToolWrapper
+	env["BUILDKITE_COLOR_MODE"] = r.conf.AgentConfiguration.ColorMode
+	env["BUILDKITE_SSH_KEYSCAN_HOST_KEY_TYPES"] = strings.Join(r.conf.AgentConfiguration.SSHKeyscanHostKeyTypes, ",")
+	env["BUILDKITE_SSH_KEYSCAN_MISSING_KEY_TYPES"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.SSHKeyscanMissingKeyTypes)
+	env["BUILDKITE_SSH_KNOWN_HOSTS_READ_ONLY"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.SSHKnownHostsReadOnly)
+	env["BUILDKITE_SSH_KNOWN_HOSTS_IPS"] = r.conf.AgentConfiguration.SSHKnownHostsIPs
+	env["BUILDKITE_SSH_KNOWN_HOSTS_SYSTEM"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.SSHKnownHostsSystem)
+	env["BUILDKITE_SSH_KNOWN_HOSTS_WARN_LINES"] = fmt.Sprintf("%d", r.conf.AgentConfiguration.SSHKnownHostsWarnLines)
 	env["BUILDKITE_GIT_SUBMODULES"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.GitSubmodules)
 	env["BUILDKITE_COMMAND_EVAL"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.CommandEval)
 	env["BUILDKITE_PLUGINS_ENABLED"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.PluginsEnabled)
@@ -122,6 +122,110 @@ type Config struct {
 	// Whether ssh-keyscan is run on ssh hosts before checkout
 	SSHKeyscan bool
 
+	// Path to the known_hosts file that hosts are added to
+	SSHKnownHostsPath string
+
+	// Whether hostnames are hashed when added to known_hosts
+	SSHKnownHostsHash bool
+
+	// Whether group and other access is removed from known_hosts and ~/.ssh
+	SSHKnownHostsStrictModes bool
+
+	// Whether to only log the hosts that would be added to known_hosts
+	SSHKnownHostsDryRun bool
+
+	// How many times to attempt ssh-keyscan before giving up
+	SSHKeyscanAttempts int
+
+	// Seconds to wait before retrying ssh-keyscan, doubling after each attempt
+	SSHKeyscanRetryInterval int
+
+	// The types of host key to scan for, such as ed25519 or rsa
+	SSHKeyscanKeyTypes []string
+
+	// How many hosts to scan at once
+	SSHKeyscanConcurrency int
+
+	// A command that prints known_hosts lines for a host, used instead of
+	// fetching host keys directly or with ssh-keyscan
+	SSHKeyscanCommand string
+
+	// A SOCKS5 or HTTP proxy to fetch host keys through, instead of the one
+	// from the environment
+	SSHKeyscanProxy string
+
+	// Seconds to wait for the known_hosts file lock to be acquired
+	SSHKnownHostsLockTimeout int
+
+	// A directory to keep the known_hosts lock in, instead of next to the file
+	SSHKnownHostsLockDir string
+
+	// Expected host key fingerprints, as host=SHA256:fingerprint pairs
+	SSHKnownHostsFingerprints []string
+
+	// Seconds after which hosts added to known_hosts are scanned and replaced
+	SSHKnownHostsTTL int
+
+	// A file that host keys added to known_hosts are logged to as JSON lines
+	SSHKnownHostsAuditLog string
+
+	// A known_hosts bundle to add host keys from, instead of scanning hosts
+	SSHKnownHostsSeed string
+
+	// Whether to fail straight away if the known_hosts lock is held, instead of waiting for it
+	SSHKnownHostsLockFailFast bool
+
+	// Patterns for the only hosts that can be scanned and added to known_hosts
+	SSHKnownHostsAllow []string
+
+	// Patterns for hosts that must never be scanned and added to known_hosts
+	SSHKnownHostsDeny []string
+
+	// Certificate authorities to trust for matching hosts instead of scanning them, as pattern=key pairs
+	SSHKnownHostsCertAuthority []string
+
+	// The StrictHostKeyChecking policy ssh is assumed to run with, which decides how known_hosts is managed
+	SSHStrictHostKeyChecking string
+
+	// Whether hosts are added to a known_hosts file that's only used for this job, instead of the shared one
+	SSHKnownHostsJobScoped bool
+
+	// Whether hosts already in known_hosts are scanned again to check their keys haven't changed
+	SSHKnownHostsVerify bool
+
+	// Seconds ssh-keyscan waits for a host to respond, passed to it with -T
+	SSHKeyscanConnectTimeout int
+
+	// Whether known_hosts and its directory are fsynced after they're changed
+	SSHKnownHostsFsync bool
+
+	// Whether every command the bootstrap runs is logged with how it exited and how long it took
+	TraceCommands bool
+
+	// A command that ssh-keyscan is run through, e.g. to set up a FIPS module
+	SSHToolWrapper string
+
+	// Whether the bootstrap's output is styled with ANSI colors, one of auto, always or never
+	ColorMode string
+
+	// The key types to scan hosts matching a pattern for, as pattern=type pairs
+	SSHKeyscanHostKeyTypes []string
+
+	// Whether hosts already in known_hosts are scanned for the key types they have no entries for
+	SSHKeyscanMissingKeyTypes bool
+
+	// Whether known_hosts is only checked for hosts, and never written or locked
+	SSHKnownHostsReadOnly bool
+
+	// Whether hosts' IP addresses are recorded along with their hostnames, shared or scan
+	SSHKnownHostsIPs string
+
+	// Whether hosts are added to the system-wide known_hosts shared by every user
+	SSHKnownHostsSystem bool
+
+	// How many lines known_hosts can have before adding hosts to it warns that it's grown too large, zero never warns
+	SSHKnownHostsWarnLines int
+
 	// The shell used to execute commands
 	Shell string
 
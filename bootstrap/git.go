@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"net"
 	"net/url"
 	"path/filepath"
 	"regexp"
@@ -158,6 +159,72 @@ func gitEnumerateSubmoduleURLs(sh *shell.Shell) ([]string, error) {
 	return urls, nil
 }
 
+// gitURLRewrite is one of git's url.<base>.insteadOf rules, which has git use
+// repository urls starting with InsteadOf as if they started with Base, e.g. to
+// fetch https://github.com/ urls over ssh with git@github.com:
+type gitURLRewrite struct {
+	Base      string
+	InsteadOf string
+}
+
+// gitURLRewrites returns the url.<base>.insteadOf rules in the git config. git
+// exits with an error when there aren't any, so an error means there are none.
+func gitURLRewrites(r Runner) []gitURLRewrite {
+	output, err := r.RunAndCapture("git", "config", "--null", "--get-regexp", `^url\..*\.insteadof$`)
+	if err != nil {
+		return nil
+	}
+
+	return parseGitURLRewrites(output)
+}
+
+// parseGitURLRewrites parses the output of
+// `git config --null --get-regexp '^url\..*\.insteadof$'`, which looks like:
+// url.git@github.com:.insteadof\nhttps://github.com/\0
+func parseGitURLRewrites(output string) []gitURLRewrite {
+	var rewrites []gitURLRewrite
+
+	for _, entry := range strings.Split(strings.TrimRight(output, "\x00"), "\x00") {
+		tokens := strings.SplitN(entry, "\n", 2)
+		if len(tokens) != 2 {
+			continue
+		}
+
+		// The base is a subsection, so it keeps its case and can contain dots
+		key := tokens[0]
+		if !strings.HasPrefix(strings.ToLower(key), "url.") || !strings.HasSuffix(strings.ToLower(key), ".insteadof") {
+			continue
+		}
+		base := key[len("url.") : len(key)-len(".insteadof")]
+
+		rewrites = append(rewrites, gitURLRewrite{Base: base, InsteadOf: tokens[1]})
+	}
+
+	return rewrites
+}
+
+// rewriteGitURL applies the rewrite rule git would use for a repository url,
+// which is the one with the longest matching prefix, returning whether any
+// matched
+func rewriteGitURL(repository string, rewrites []gitURLRewrite) (string, gitURLRewrite, bool) {
+	var match gitURLRewrite
+	found := false
+
+	for _, rewrite := range rewrites {
+		if !strings.HasPrefix(repository, rewrite.InsteadOf) {
+			continue
+		}
+		if !found || len(rewrite.InsteadOf) > len(match.InsteadOf) {
+			match, found = rewrite, true
+		}
+	}
+
+	if !found {
+		return repository, gitURLRewrite{}, false
+	}
+	return match.Base + strings.TrimPrefix(repository, match.InsteadOf), match, true
+}
+
 func gitRevParseInWorkingDirectory(sh *shell.Shell, workingDirectory string, extraRevParseArgs ...string) (string, error) {
 	gitDirectory := filepath.Join(workingDirectory, ".git")
 
@@ -169,7 +236,7 @@ func gitRevParseInWorkingDirectory(sh *shell.Shell, workingDirectory string, ext
 
 var (
 	hasSchemePattern  = regexp.MustCompile("^[^:]+://")
-	scpLikeURLPattern = regexp.MustCompile("^([^@]+@)?([^:]{2,}):/?(.+)$")
+	scpLikeURLPattern = regexp.MustCompile(`^([^@]+@)?(\[[^\]]+\]|[^:]{2,}):/?(.+)$`)
 )
 
 // parseGittableURL parses and converts a git repository url into a url.URL
@@ -194,22 +261,47 @@ func parseGittableURL(ref string) (*url.URL, error) {
 // https://buildkite.com/docs/agent/ssh-keys#creating-multiple-ssh-keys
 var gitHostAliasRegexp = regexp.MustCompile(`-[a-z0-9\-]+$`)
 
-func resolveGitHost(sh *shell.Shell, host string) string {
-	var hostname string
-	var port string
+// sshHost is where an ssh host, which may be an alias from the user's ssh
+// config, really is
+type sshHost struct {
+	// The address to connect to, with the port if it isn't 22
+	Addr string
 
+	// The name OpenSSH looks the host's keys up by in known_hosts when
+	// connecting, which is the address unless HostKeyAlias is set
+	Name string
+}
+
+// resolveGitHost resolves an ssh host through the user's ssh config with `ssh
+// -G`, so aliases are scanned at the HostName and Port they point to
+func resolveGitHost(sh *shell.Shell, host string) sshHost {
 	// ask SSH to print its configuration for this host, honouring .ssh/config
-	output, err := sh.RunAndCapture("ssh", "-G", host)
+	output, err := sshConfigForHost(sh, host)
+	if err != nil {
+		output = ""
+	}
+
+	return parseSSHConfigHost(host, output)
+}
+
+// parseSSHConfigHost returns where a host really is from the output of `ssh
+// -G` for it, falling back to removing any key identifier from the host if the
+// output doesn't have its hostname
+func parseSSHConfigHost(host string, output string) sshHost {
+	var hostname string
+	var port string
+	var hostKeyAlias string
 
-	// if we got no error, let's process the output
-	if err == nil {
+	// if we got some output, let's process it
+	if output != "" {
 		// split up the ssh -G output by lines
 		scanner := bufio.NewScanner(bytes.NewBufferString(output))
 
 		for scanner.Scan() {
 			line := scanner.Text()
 
-			// search the ssh -G output for "hostname" and "port" lines
+			// search the ssh -G output for "hostname", "port" and
+			// "hostkeyalias" lines
 			tokens := strings.SplitN(line, " ", 2)
 
 			// skip any line which isn't a key-value pair
@@ -218,34 +310,51 @@ func resolveGitHost(sh *shell.Shell, host string) string {
 			}
 
 			// grab the values we care about
-			if tokens[0] == "hostname" {
+			switch tokens[0] {
+			case "hostname":
 				hostname = tokens[1]
-			} else if tokens[0] == "port" {
+			case "port":
 				port = tokens[1]
-			}
-
-			// if we have both values, we're done here!
-			if hostname != "" && port != "" {
-				break
+			case "hostkeyalias":
+				hostKeyAlias = tokens[1]
 			}
 		}
 	}
 
 	// if we got out of that with a hostname, things worked
 	if hostname != "" {
-		// if the port is the default, we can leave it off
-		if port == "22" {
-			return hostname
+		addr := hostname
+
+		// if the port isn't the default, output it in hostname:port form
+		// (bracketing IPv6 literals)
+		if port != "22" && port != "" {
+			addr = net.JoinHostPort(hostname, port)
+		}
+
+		// OpenSSH uses the alias as is, without the port
+		if hostKeyAlias != "" {
+			return sshHost{Addr: addr, Name: hostKeyAlias}
 		}
 
-		// otherwise, output it in hostname:port form
-		return fmt.Sprintf("%s:%s", hostname, port)
+		return sshHost{Addr: addr, Name: addr}
 	}
 
 	// if we got here, either the `-G` flag was unsupported, or ssh -G
 	// didn't return a value for hostname (weird!),
 	// so we fall back to the old behaviour of just replacing strings
-	return gitHostAliasRegexp.ReplaceAllString(host, "")
+	addr := gitHostAliasRegexp.ReplaceAllString(host, "")
+	return sshHost{Addr: addr, Name: addr}
+}
+
+// sshConfigForHost returns the output of `ssh -G` for a host, running the ssh
+// found the same way as the other ssh tools
+func sshConfigForHost(sh *shell.Shell, host string) (string, error) {
+	sshPath, err := findSSHTool(sh, "ssh")
+	if err != nil {
+		return "", err
+	}
+
+	return sh.RunAndCapture(sshPath, "-G", host)
 }
 
 // gitCheckRefFormatDenyRegexp is a pattern used by gitCheckRefFormat().
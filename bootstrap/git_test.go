@@ -1,6 +1,7 @@
 package bootstrap
 
 import (
+	"errors"
 	"path/filepath"
 	"reflect"
 	"testing"
@@ -51,6 +52,18 @@ func TestParsingGittableRepositoryFromGitURLsWithAliases(t *testing.T) {
 	assert.Equal(t, `github.com-alias1`, u.Host)
 }
 
+func TestParsingGittableRepositoryFromGitURLsWithIPv6(t *testing.T) {
+	t.Parallel()
+
+	u, err := parseGittableURL(`git@[2001:db8::1]:buildkite/agent.git`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `ssh://git@[2001:db8::1]/buildkite/agent.git`, u.String())
+	assert.Equal(t, `[2001:db8::1]`, u.Host)
+	assert.Equal(t, `2001:db8::1`, u.Hostname())
+}
+
 func TestParsingGittableRepositoryFromSSHURLsWithPorts(t *testing.T) {
 	t.Parallel()
 
@@ -69,6 +82,49 @@ func TestParsingGittableRepositoryFromSSHURLsWithPorts(t *testing.T) {
 	assert.Equal(t, `git.host.de:4019`, u.Host)
 }
 
+func TestParsingGitURLRewrites(t *testing.T) {
+	t.Parallel()
+
+	runner := &testRunner{outputs: map[string]testRunnerOutput{
+		"git": {stdout: "url.git@github.com:.insteadof\nhttps://github.com/\x00" +
+			"url.ssh://git@Git.Example.com:2222/.insteadof\nhttps://git.example.com/\x00" +
+			"url.broken\x00"},
+	}}
+
+	assert.Equal(t, []gitURLRewrite{
+		{Base: "git@github.com:", InsteadOf: "https://github.com/"},
+		{Base: "ssh://git@Git.Example.com:2222/", InsteadOf: "https://git.example.com/"},
+	}, gitURLRewrites(runner))
+	assert.Equal(t, []string{`git config --null --get-regexp ^url\..*\.insteadof$`}, runner.calls)
+
+	// git exits with an error when there aren't any
+	runner.outputs["git"] = testRunnerOutput{err: errors.New("exit status 1")}
+	assert.Empty(t, gitURLRewrites(runner))
+}
+
+func TestRewritingGitURLs(t *testing.T) {
+	t.Parallel()
+
+	rewrites := []gitURLRewrite{
+		{Base: "git@github.com:", InsteadOf: "https://github.com/"},
+		{Base: "git@github.com:buildkite/", InsteadOf: "https://github.com/buildkite/"},
+	}
+
+	// The longest matching prefix wins, like it does in git
+	rewritten, rewrite, ok := rewriteGitURL("https://github.com/buildkite/agent.git", rewrites)
+	assert.True(t, ok)
+	assert.Equal(t, "git@github.com:buildkite/agent.git", rewritten)
+	assert.Equal(t, rewrites[1], rewrite)
+
+	rewritten, _, ok = rewriteGitURL("https://github.com/other/repo.git", rewrites)
+	assert.True(t, ok)
+	assert.Equal(t, "git@github.com:other/repo.git", rewritten)
+
+	rewritten, _, ok = rewriteGitURL("https://gitlab.com/other/repo.git", rewrites)
+	assert.False(t, ok)
+	assert.Equal(t, "https://gitlab.com/other/repo.git", rewritten)
+}
+
 func TestResolvingGitHostAliasesWithFlagSupport(t *testing.T) {
 	t.Parallel()
 
@@ -154,7 +210,7 @@ streamlocalbindmask 0177
 syslogfacility USER`).
 		AndExitWith(0)
 
-	assert.Equal(t, "github.com", resolveGitHost(sh, "github.com-alias1"))
+	assert.Equal(t, "github.com", resolveGitHost(sh, "github.com-alias1").Addr)
 
 	ssh.
 		Expect("-G", "blargh-no-alias.com").
@@ -228,7 +284,7 @@ streamlocalbindmask 0177
 syslogfacility USER`).
 		AndExitWith(0)
 
-	assert.Equal(t, "blargh-no-alias.com", resolveGitHost(sh, "blargh-no-alias.com"))
+	assert.Equal(t, "blargh-no-alias.com", resolveGitHost(sh, "blargh-no-alias.com").Addr)
 
 	ssh.
 		Expect("-G", "cool-alias").
@@ -302,7 +358,41 @@ streamlocalbindmask 0177
 syslogfacility USER`).
 		AndExitWith(0)
 
-	assert.Equal(t, "rad-git-host.com:443", resolveGitHost(sh, "cool-alias"))
+	assert.Equal(t, "rad-git-host.com:443", resolveGitHost(sh, "cool-alias").Addr)
+}
+
+func TestResolvingGitHostAliasesWithHostKeyAlias(t *testing.T) {
+	t.Parallel()
+
+	sh := shell.NewTestShell(t)
+
+	ssh, err := bintest.NewMock("ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ssh.CheckAndClose(t)
+
+	sh.Env.Set("PATH", filepath.Dir(ssh.Path))
+
+	ssh.
+		Expect("-G", "git-internal").
+		AndWriteToStdout(`user buildkite
+hostname real.example.com
+port 2222
+hostkeyalias git-internal-keys
+stricthostkeychecking ask`).
+		AndExitWith(0)
+
+	assert.Equal(t, sshHost{Addr: "real.example.com:2222", Name: "git-internal-keys"}, resolveGitHost(sh, "git-internal"))
+
+	ssh.
+		Expect("-G", "git-internal").
+		AndWriteToStdout(`user buildkite
+hostname real.example.com
+port 22`).
+		AndExitWith(0)
+
+	assert.Equal(t, sshHost{Addr: "real.example.com", Name: "real.example.com"}, resolveGitHost(sh, "git-internal"))
 }
 
 func TestResolvingGitHostAliasesWithoutFlagSupport(t *testing.T) {
@@ -331,7 +421,7 @@ usage: ssh [-1246AaCfgKkMNnqsTtVvXxYy] [-b bind_address] [-c cipher_spec]
            [-w local_tun[:remote_tun]] [user@]hostname [command]`).
 		AndExitWith(255)
 
-	assert.Equal(t, "github.com", resolveGitHost(sh, "github.com-alias1"))
+	assert.Equal(t, "github.com", resolveGitHost(sh, "github.com-alias1").Addr)
 
 	ssh.
 		Expect("-G", "blargh-no-alias.com").
@@ -346,7 +436,7 @@ usage: ssh [-1246AaCfgKkMNnqsTtVvXxYy] [-b bind_address] [-c cipher_spec]
            [-w local_tun[:remote_tun]] [user@]hostname [command]`).
 		AndExitWith(255)
 
-	assert.Equal(t, "blargh-no-alias.com", resolveGitHost(sh, "blargh-no-alias.com"))
+	assert.Equal(t, "blargh-no-alias.com", resolveGitHost(sh, "blargh-no-alias.com").Addr)
 }
 
 func TestGitCheckRefFormat(t *testing.T) {
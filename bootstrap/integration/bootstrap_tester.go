@@ -98,6 +98,7 @@ func NewBootstrapTester() (*BootstrapTester, error) {
 			`BUILDKITE_JOB_ID=1111-1111-1111-1111`,
 			`BUILDKITE_AGENT_ACCESS_TOKEN=test`,
 		},
+		HomeDir:    homeDir,
 		PathDir:    pathDir,
 		BuildDir:   buildDir,
 		HooksDir:   hooksDir,
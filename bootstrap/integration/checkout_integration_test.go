@@ -1,9 +1,12 @@
 package integration
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -13,6 +16,8 @@ import (
 
 	"github.com/buildkite/agent/v3/experiments"
 	"github.com/buildkite/bintest/v3"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 // Example commit info:
@@ -411,6 +416,54 @@ func TestCheckingOutSetsCorrectGitMetadataAndSendsItToBuildkite(t *testing.T) {
 func TestCheckingOutWithSSHKeyscan(t *testing.T) {
 	t.Parallel()
 
+	addr, hostKey := startTestSSHServer(t)
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := fmt.Sprintf("ssh://git@%s/buildkite/agent.git", addr)
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tester.Close()
+
+	// The host key is fetched natively, so ssh-keyscan isn't needed
+	tester.MustMock(t, "ssh-keyscan").
+		Expect(bintest.MatchAny()).
+		NotCalled()
+
+	expectClone(t, tester, repo)
+
+	env := []string{
+		`BUILDKITE_REPO=` + repo,
+		`BUILDKITE_SSH_KEYSCAN=true`,
+	}
+
+	tester.RunAndCheck(t, env...)
+
+	assertKnownHostsContains(t, tester, knownhosts.Line([]string{knownhosts.Normalize(net.JoinHostPort(host, port))}, hostKey))
+}
+
+func TestCheckingOutWithSSHKeyscanFallback(t *testing.T) {
+	t.Parallel()
+
+	// Nothing's listening, so fetching the host key natively fails
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := fmt.Sprintf("ssh://git@%s/buildkite/agent.git", addr)
+	line := "[" + host + "]:" + port + " ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl"
+
 	tester, err := NewBootstrapTester()
 	if err != nil {
 		t.Fatal(err)
@@ -418,27 +471,91 @@ func TestCheckingOutWithSSHKeyscan(t *testing.T) {
 	defer tester.Close()
 
 	tester.MustMock(t, "ssh-keyscan").
-		Expect("github.com").
-		AndWriteToStdout("github.com ssh-rsa xxx=").
+		Expect("-t", "ed25519,ecdsa,rsa", "-p", port, host).
+		Once().
+		AndWriteToStdout(line).
 		AndExitWith(0)
 
+	expectClone(t, tester, repo)
+
+	env := []string{
+		`BUILDKITE_REPO=` + repo,
+		`BUILDKITE_SSH_KEYSCAN=true`,
+	}
+
+	tester.RunAndCheck(t, env...)
+
+	assertKnownHostsContains(t, tester, line)
+}
+
+// expectClone mocks git, expecting repo to be cloned
+func expectClone(t *testing.T, tester *BootstrapTester, repo string) {
 	git := tester.MustMock(t, "git")
 	git.IgnoreUnexpectedInvocations()
 
 	if experiments.IsEnabled(`git-mirrors`) {
-		git.Expect("clone", "--mirror", "-v", "--", "git@github.com:buildkite/agent.git", bintest.MatchAny()).
+		git.Expect("clone", "--mirror", "-v", "--", repo, bintest.MatchAny()).
 			AndExitWith(0)
 	} else {
-		git.Expect("clone", "-v", "--", "git@github.com:buildkite/agent.git", ".").
+		git.Expect("clone", "-v", "--", repo, ".").
 			AndExitWith(0)
 	}
+}
 
-	env := []string{
-		`BUILDKITE_REPO=git@github.com:buildkite/agent.git`,
-		`BUILDKITE_SSH_KEYSCAN=true`,
+// assertKnownHostsContains asserts that the known_hosts in the tester's home
+// directory has an entry starting with line, ignoring any comment after it
+func assertKnownHostsContains(t *testing.T, tester *BootstrapTester, line string) {
+	t.Helper()
+
+	contents, err := ioutil.ReadFile(filepath.Join(tester.HomeDir, ".ssh", "known_hosts"))
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	tester.RunAndCheck(t, env...)
+	for _, entry := range strings.Split(string(contents), "\n") {
+		if strings.HasPrefix(entry, strings.TrimSpace(line)) {
+			return
+		}
+	}
+	t.Errorf("Expected known_hosts to contain %q, got %q", line, contents)
+}
+
+// startTestSSHServer starts an SSH server on a random local port that only
+// presents its host key, returning its address and key
+func startTestSSHServer(t *testing.T) (string, ssh.PublicKey) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _, _, _ = ssh.NewServerConn(conn, config)
+			}()
+		}
+	}()
+
+	return ln.Addr().String(), signer.PublicKey()
 }
 
 func TestCheckingOutWithoutSSHKeyscan(t *testing.T) {
@@ -451,7 +568,7 @@ func TestCheckingOutWithoutSSHKeyscan(t *testing.T) {
 	defer tester.Close()
 
 	tester.MustMock(t, "ssh-keyscan").
-		Expect("github.com").
+		Expect(bintest.MatchAny()).
 		NotCalled()
 
 	env := []string{
@@ -472,7 +589,7 @@ func TestCheckingOutWithSSHKeyscanAndUnscannableRepo(t *testing.T) {
 	defer tester.Close()
 
 	tester.MustMock(t, "ssh-keyscan").
-		Expect("github.com").
+		Expect(bintest.MatchAny()).
 		NotCalled()
 
 	git := tester.MustMock(t, "git")
@@ -2,40 +2,410 @@ package bootstrap
 
 import (
 	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/buildkite/agent/v3/bootstrap/shell"
 	homedir "github.com/mitchellh/go-homedir"
+	"github.com/nightlyone/lockfile"
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/knownhosts"
 )
 
+// knownHosts adds hosts to a known_hosts file. It only ever reads and writes
+// that file and its lock, and never touches ssh-agent or SSH_AUTH_SOCK, so
+// jobs that rely on a particular agent see it exactly as they left it. If keys
+// are ever added to an agent, it'll need to be opted into separately.
 type knownHosts struct {
 	Shell *shell.Shell
 	Path  string
+
+	// Whether to hash hostnames before writing them, like OpenSSH's
+	// `HashKnownHosts yes`
+	Hash bool
+
+	// How host keys are scanned
+	Scan sshKeyScanConfig
+
+	// How long to wait for the known_hosts file lock, defaults to 30 seconds
+	LockTimeout time.Duration
+
+	// Whether to try the lock once and fail straight away if it's held,
+	// instead of waiting up to LockTimeout for it
+	LockFailFast bool
+
+	// Stops waiting for the lock when it's done, e.g. when a job is
+	// cancelled. Defaults to the shell's context.
+	Context context.Context
+
+	// How the file is locked while it's checked and changed, defaults to a
+	// lock file next to it
+	Locker knownHostsLocker
+
+	// Where entries are read from and appended to, defaults to the file at
+	// Path. Removing entries always replaces the file at Path.
+	File knownHostsFile
+
+	// Whether to fsync the directory known_hosts is in after it's changed, and
+	// the file that replaces it when entries are removed, so changes survive
+	// the machine being terminated abruptly, e.g. a preempted spot instance.
+	// Appended entries are always synced, but without the directory a newly
+	// created known_hosts can still be lost.
+	Fsync bool
+
+	// Expected SHA256 host key fingerprints keyed by normalized host. Only
+	// matching keys are written for these hosts, entries that are already in
+	// known_hosts are trusted as is.
+	Fingerprints map[string][]string
+
+	// Whether to only log the hosts that would be scanned and added, without
+	// scanning them or writing to known_hosts
+	DryRun bool
+
+	// How long entries added by the agent are kept before the host is scanned
+	// again and its entries replaced, so rotated host keys are picked up. Zero
+	// means entries are never refreshed. When set, a comment recording when the
+	// host was added is written before its entries.
+	TTL time.Duration
+
+	// How many lines known_hosts can have before adding hosts to it warns
+	// that it's grown too large, zero never warns
+	WarnLines int
+
+	// Called for each host key once it's been written to known_hosts, e.g. to
+	// keep an audit log
+	OnAdd func(knownHostsEvent)
+
+	// How many hosts AddMany scans at once, defaults to
+	// defaultKnownHostsScanConcurrency
+	ScanConcurrency int
+
+	// Called with how long each phase of adding a host took, if set
+	OnTiming func(knownHostsTiming)
+
+	// Called before known_hosts is changed, with the lock held, e.g. to
+	// snapshot the file. Returning an error stops the change being made.
+	BeforeChange func(knownHostsChange) error
+
+	// Called after known_hosts has been changed, once the lock is released
+	AfterChange func(knownHostsChange)
+
+	// Changes made while the lock is held, for AfterChange
+	changes []knownHostsChange
+
+	// The contents of known_hosts while a batch of hosts is being added, so
+	// it's read once rather than for every check, see loadSnapshot
+	snapshot *knownHostsSnapshot
+
+	// Releases the lock taken by Open, nil unless known_hosts is open
+	closer func()
+
+	// Whether to only trust hosts already in known_hosts, e.g. from a bundle
+	// added with SeedFrom, and never scan them. Hosts that aren't there are an
+	// error.
+	Offline bool
+
+	// Whether hosts are only checked for, and known_hosts is never written or
+	// locked, e.g. on agents that verify hosts against a file other agents
+	// maintain. This is best-effort, as the checks aren't serialized against
+	// writers: a host that's being added concurrently may not be seen yet.
+	ReadOnly bool
+
+	// Whether hosts already in known_hosts are scanned again and their keys
+	// compared with the ones stored for them, so a changed host key is
+	// reported when it's added rather than as a failed git command later
+	VerifyKnown bool
+
+	// Whether hosts already in known_hosts are scanned for the key types they
+	// have no entries for, so a key type newly enabled on a server is picked
+	// up. Only keys of the missing types are added.
+	ScanMissingKeyTypes bool
+
+	// Patterns for the hosts that can be scanned, e.g. github.com or
+	// *.example.com. When set, scanning any other host is an error. Hosts
+	// already in known_hosts are trusted regardless.
+	AllowedHosts []string
+
+	// Patterns for hosts that must never be scanned, taking precedence over
+	// AllowedHosts
+	DeniedHosts []string
+
+	// Certificate authorities that sign the host certificates of the hosts
+	// matching their patterns. A @cert-authority entry is written for these
+	// hosts instead of scanning them.
+	CertAuthorities []knownHostsCertAuthority
+
+	// The key types to scan the hosts matching each pattern for, instead of
+	// Scan.KeyTypes, e.g. so a host is only scanned for the type it prefers.
+	// Patterns match like AllowedHosts, and the first that matches is used.
+	HostKeyTypes []knownHostsKeyTypes
+
+	// Whether the IP addresses hosts resolve to are recorded too, for
+	// tooling that connects by IP, see knownHostsIPsShared and
+	// knownHostsIPsScan. Empty means they aren't.
+	IPs string
+
+	// Resolves hostnames to their IP addresses for IPs, defaults to
+	// net.LookupHost
+	LookupHost func(host string) ([]string, error)
+
+	// git's url.<base>.insteadOf rules, which are applied to repositories
+	// before their hosts are found, so a remote git rewrites to an ssh url is
+	// scanned even if it's given as an https one, see gitURLRewrites
+	URLRewrites []gitURLRewrite
+
+	// What runs `ssh -G` to resolve hosts, and the commands that scan them,
+	// defaults to Shell. They're run by name, rather than the paths the ssh
+	// tools are found at.
+	Runner Runner
+}
+
+// knownHostsKeyTypes are the key types the hosts matching Pattern are scanned
+// for, e.g. *.example.com
+type knownHostsKeyTypes struct {
+	Pattern  string
+	KeyTypes []string
+}
+
+// knownHostsCertAuthority is a CA whose signed host certificates are trusted for
+// the hosts matching Patterns, e.g. "*.example.com,!untrusted.example.com"
+type knownHostsCertAuthority struct {
+	Patterns string
+	Key      ssh.PublicKey
+}
+
+// line returns the known_hosts @cert-authority entry for the CA
+func (ca knownHostsCertAuthority) line() string {
+	return "@cert-authority " + ca.Patterns + " " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(ca.Key)))
+}
+
+// knownHostsChange describes a change to a known_hosts file, for BeforeChange
+// and AfterChange. Host is empty for changes to the whole file.
+type knownHostsChange struct {
+	Path string
+	Host string
+	Op   string
+}
+
+// The kinds of change made to known_hosts
+const (
+	knownHostsOpAdd     = "add"
+	knownHostsOpRefresh = "refresh"
+	knownHostsOpRemove  = "remove"
+	knownHostsOpPrune   = "prune"
+	knownHostsOpDedup   = "dedup"
+	knownHostsOpSeed    = "seed"
+)
+
+// beforeChange calls BeforeChange, if it's set, for a change that's about to
+// be made with the lock held. An error means the change mustn't be made.
+func (kh *knownHosts) beforeChange(op string, host string) error {
+	if kh.BeforeChange == nil {
+		return nil
+	}
+
+	if err := kh.BeforeChange(knownHostsChange{Path: kh.Path, Host: host, Op: op}); err != nil {
+		if host == "" {
+			return errors.Wrapf(err, "Not changing known hosts at %q, %s was stopped", kh.Path, op)
+		}
+		return errors.Wrapf(err, "Not changing known hosts at %q, %s of %q was stopped", kh.Path, op, host)
+	}
+
+	return nil
+}
+
+// changed records a change that was made with the lock held, so AfterChange
+// is called for it once the lock is released
+func (kh *knownHosts) changed(op string, host string) {
+	if kh.AfterChange != nil {
+		kh.changes = append(kh.changes, knownHostsChange{Path: kh.Path, Host: host, Op: op})
+	}
+}
+
+// knownHostsTiming records how long a phase of adding a host to known_hosts
+// took. Host is empty for the lock taken by AddMany, which covers several hosts.
+type knownHostsTiming struct {
+	Host     string
+	Phase    string
+	Duration time.Duration
+}
+
+// The phases of adding a host that are timed
+const (
+	knownHostsPhaseLock  = "lock"
+	knownHostsPhaseCheck = "check"
+	knownHostsPhaseScan  = "scan"
+	knownHostsPhaseWrite = "write"
+)
+
+// timed reports how long a phase took since start to OnTiming, if it's set.
+// time.Since uses the monotonic clock, so this is cheap and unaffected by
+// changes to the wall clock.
+func (kh *knownHosts) timed(phase string, host string, start time.Time) {
+	if kh.OnTiming != nil {
+		kh.report(phase, host, time.Since(start))
+	}
+}
+
+// report reports how long a phase took to OnTiming, if it's set
+func (kh *knownHosts) report(phase string, host string, d time.Duration) {
+	if kh.OnTiming != nil {
+		kh.OnTiming(knownHostsTiming{Host: host, Phase: phase, Duration: d})
+	}
 }
 
-func findKnownHosts(sh *shell.Shell) (*knownHosts, error) {
-	userHomePath, err := homedir.Dir()
+// defaultKnownHostsScanConcurrency is how many hosts are scanned at once by
+// default, kept small so a build with many submodules doesn't trip connection
+// rate limits on the git host
+const defaultKnownHostsScanConcurrency = 4
+
+// knownHostsEvent records a host key being written to known_hosts
+type knownHostsEvent struct {
+	Time        time.Time `json:"time"`
+	Path        string    `json:"path"`
+	Host        string    `json:"host"`
+	KeyType     string    `json:"key_type"`
+	Fingerprint string    `json:"fingerprint"`
+}
+
+// knownHostsCache remembers hosts that are known to be in a known_hosts file,
+// so adding them again, e.g. for plugins and submodules on the same host, needs
+// neither the lock nor to read the file. The file is still the source of
+// truth, hosts are only remembered for knownHostsCacheTTL.
+var knownHostsCache = struct {
+	sync.Mutex
+	hosts map[string]time.Time
+}{hosts: map[string]time.Time{}}
+
+var knownHostsCacheTTL = time.Minute
+
+func (kh *knownHosts) cacheKey(host string) string {
+	return kh.Path + "\x00" + normalizeHost(host)
+}
+
+// cached returns whether a host was recently seen in known_hosts
+func (kh *knownHosts) cached(host string) bool {
+	knownHostsCache.Lock()
+	defer knownHostsCache.Unlock()
+
+	key := kh.cacheKey(host)
+	if added, ok := knownHostsCache.hosts[key]; ok {
+		if time.Since(added) < knownHostsCacheTTL {
+			return true
+		}
+		delete(knownHostsCache.hosts, key)
+	}
+
+	return false
+}
+
+// remember records that a host is in known_hosts
+func (kh *knownHosts) remember(host string) {
+	knownHostsCache.Lock()
+	defer knownHostsCache.Unlock()
+
+	knownHostsCache.hosts[kh.cacheKey(host)] = time.Now()
+}
+
+// forget removes a host from the cache of hosts known to be in known_hosts
+func (kh *knownHosts) forget(host string) {
+	knownHostsCache.Lock()
+	defer knownHostsCache.Unlock()
+
+	delete(knownHostsCache.hosts, kh.cacheKey(host))
+}
+
+// forgetAll forgets every host remembered for the known_hosts file
+func (kh *knownHosts) forgetAll() {
+	knownHostsCache.Lock()
+	defer knownHostsCache.Unlock()
+
+	for key := range knownHostsCache.hosts {
+		if strings.HasPrefix(key, kh.Path+"\x00") {
+			delete(knownHostsCache.hosts, key)
+		}
+	}
+}
+
+// knownHostsMarkerPrefix starts the comment written before the entries the
+// agent adds, which records when they were added
+const knownHostsMarkerPrefix = "# Added by buildkite-agent for "
+
+// knownHostsManagedComment is added to the end of each entry the agent writes,
+// followed by the time, as the key comment OpenSSH ignores. This means they can
+// be told apart from entries added by hand. The comment can't contain spaces,
+// as golang.org/x/crypto/ssh only accepts a single word.
+const knownHostsManagedComment = "buildkite-agent-added:"
+
+// findKnownHosts returns the known_hosts file at path, creating it if needed.
+// If path is empty, the current user's ~/.ssh/known_hosts is used.
+func findKnownHosts(sh *shell.Shell, path string) (*knownHosts, error) {
+	return findKnownHostsContext(sh.Context(), sh, path)
+}
+
+// findKnownHostsContext is like findKnownHosts, but gives up once ctx is done,
+// and the known_hosts file it returns stops waiting for its lock then too, so
+// finding and changing it can be cancelled as a whole. The file operations
+// themselves can't be interrupted, so ctx is checked between them.
+func findKnownHostsContext(ctx context.Context, sh *shell.Shell, path string) (*knownHosts, error) {
+	cancelled := func() error {
+		if err := ctx.Err(); err != nil {
+			return errors.Wrapf(err, "Cancelled finding known_hosts file")
+		}
+		return nil
+	}
+
+	if err := cancelled(); err != nil {
+		return nil, err
+	}
+
+	knownHostPath, err := knownHostsPath(path)
 	if err != nil {
-		return nil, fmt.Errorf("Could not find the current users home directory (%s)", err)
+		return nil, err
 	}
 
-	// Construct paths to the known_hosts file
-	sshDirectory := filepath.Join(userHomePath, ".ssh")
-	knownHostPath := filepath.Join(sshDirectory, "known_hosts")
+	sshDirectory := filepath.Dir(knownHostPath)
+
+	// A misprovisioned ~/.ssh can be a file, which MkdirAll would only report
+	// as a cryptic "not a directory" error
+	if info, err := os.Stat(sshDirectory); err == nil && !info.IsDir() {
+		return nil, fmt.Errorf("%q exists but is not a directory, so known_hosts can't be created in it. Remove or rename it so it can be created as a directory", sshDirectory)
+	}
 
 	// Ensure ssh directory exists
 	if err := os.MkdirAll(sshDirectory, 0700); err != nil {
+		return nil, errors.Wrapf(err, "Could not create directory %q for known_hosts", sshDirectory)
+	}
+
+	if err := cancelled(); err != nil {
 		return nil, err
 	}
 
-	// Ensure file exists
-	if _, err := os.Stat(knownHostPath); err != nil {
+	// Ensure file exists, and is a file that can be read. Only create it if
+	// it's really missing, so other problems aren't hidden until it's written.
+	info, err := os.Stat(knownHostPath)
+	switch {
+	case os.IsNotExist(err):
 		f, err := os.OpenFile(knownHostPath, os.O_CREATE|os.O_WRONLY, 0600)
 		if err != nil {
 			return nil, errors.Wrapf(err, "Could not create %q", knownHostPath)
@@ -43,19 +413,186 @@ func findKnownHosts(sh *shell.Shell) (*knownHosts, error) {
 		if err = f.Close(); err != nil {
 			return nil, err
 		}
+
+	case err != nil:
+		return nil, errors.Wrapf(err, "Could not access known_hosts file %q", knownHostPath)
+
+	case info.IsDir():
+		return nil, fmt.Errorf("Expected known_hosts file %q to be a file, but it's a directory", knownHostPath)
+
+	default:
+		f, err := os.Open(knownHostPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Known_hosts file %q exists but is not readable", knownHostPath)
+		}
+		_ = f.Close()
+	}
+
+	if err := cancelled(); err != nil {
+		return nil, err
+	}
+
+	return &knownHosts{
+		Shell:   sh,
+		Path:    knownHostPath,
+		Locker:  &fileLocker{Shell: sh, Path: knownHostPath + ".lock", Context: ctx},
+		Context: ctx,
+	}, nil
+}
+
+// dryRunKnownHosts returns the known_hosts file at path for a dry run, which
+// unlike findKnownHosts doesn't create it or its directory. A missing file is
+// treated as empty.
+func dryRunKnownHosts(sh *shell.Shell, path string) (*knownHosts, error) {
+	knownHostPath, err := knownHostsPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &knownHosts{Shell: sh, Path: knownHostPath, DryRun: true}, nil
+}
+
+// knownHostsPath returns path, or the current user's ~/.ssh/known_hosts if
+// it's empty
+func knownHostsPath(path string) (string, error) {
+	if path != "" {
+		return path, nil
+	}
+
+	userHomePath, err := userHomeDir()
+	if err != nil {
+		return "", &noHomeDirectoryError{Err: err}
+	}
+
+	// Construct paths to the known_hosts file
+	return filepath.Join(userHomePath, ".ssh", "known_hosts"), nil
+}
+
+// userHomeDir returns the current user's home directory, tests can replace it
+var userHomeDir = homedir.Dir
+
+// noHomeDirectoryError is returned by knownHostsPath when it needs the current
+// user's home directory but can't find it, e.g. because HOME isn't set
+type noHomeDirectoryError struct {
+	Err error
+}
+
+func (e *noHomeDirectoryError) Error() string {
+	return fmt.Sprintf("Could not find the current users home directory (%s)", e.Err)
+}
+
+// fallbackKnownHostsPath returns where known_hosts is kept when the current
+// user's home directory can't be found, which is under the working directory
+func fallbackKnownHostsPath() (string, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", errors.Wrap(err, "Could not find the working directory")
+	}
+
+	return filepath.Join(wd, ".buildkite-agent", "ssh", "known_hosts"), nil
+}
+
+// systemKnownHostsPath is where the known_hosts shared by every user on the
+// machine is, which ssh checks as well as the user's own. Tests can replace it.
+var systemKnownHostsPath = func() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(programDataDir(), "ssh", "ssh_known_hosts")
+	}
+	return "/etc/ssh/ssh_known_hosts"
+}
+
+// systemKnownHostsLockDir is where the lock for the system-wide known_hosts is
+// kept by default, as agents running as different users often can't create
+// files next to it. It mustn't depend on the user, e.g. through TMPDIR, or
+// they wouldn't share it. Tests can replace it.
+var systemKnownHostsLockDir = func() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(programDataDir(), "buildkite-agent", "known-hosts-locks")
+	}
+	return "/tmp/buildkite-agent-known-hosts-locks"
+}
+
+// programDataDir returns the directory Windows keeps data shared between users
+// in, usually C:\ProgramData
+func programDataDir() string {
+	if dir := os.Getenv("ProgramData"); dir != "" {
+		return dir
+	}
+	return `C:\ProgramData`
+}
+
+// checkSystemKnownHosts returns an error if the system-wide known_hosts at
+// path can't be written to, creating it if it's missing so that every user can
+// read it. Its directory isn't created, as it's managed by the system's ssh.
+func checkSystemKnownHosts(path string) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if os.IsNotExist(err) {
+		if f, err = os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644); err == nil {
+			// Regardless of the umask, ssh running as any user has to read it
+			err = os.Chmod(path, 0644)
+		}
+	}
+	if f != nil {
+		_ = f.Close()
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Could not write to the system-wide known_hosts %q", path)
+	}
+	return nil
+}
+
+// tightenPermissions removes group and other access from the known_hosts file,
+// and from the directory it's in if that's a .ssh directory, as ssh requires
+// with StrictModes. Other directories, e.g. /etc/ssh, are left alone.
+func (kh *knownHosts) tightenPermissions() error {
+	// Windows doesn't have unix permissions to tighten
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	paths := []string{kh.Path}
+	if dir := filepath.Dir(kh.Path); filepath.Base(dir) == ".ssh" {
+		paths = append(paths, dir)
+	}
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+
+		if mode := info.Mode().Perm(); mode&0077 != 0 {
+			kh.Shell.Commentf("Tightening permissions of \"%s\" from %v to %v", path, mode, mode&^0077)
+			if err := os.Chmod(path, mode&^0077); err != nil {
+				return errors.Wrapf(err, "Could not tighten permissions of %q", path)
+			}
+		}
 	}
 
-	return &knownHosts{Shell: sh, Path: knownHostPath}, nil
+	return nil
 }
 
+// Contains returns whether known_hosts has an entry for a host, which may
+// include a port, matching hashed entries too. It only reads the file, and
+// doesn't wait for the lock, so it's safe to use as a preflight check while
+// another agent is adding hosts. Entries are only ever appended in a single
+// write or replaced by renaming a new file into place, so a partially written
+// file is never seen. An error satisfying os.IsNotExist is returned if the file
+// doesn't exist.
 func (kh *knownHosts) Contains(host string) (bool, error) {
-	file, err := os.Open(kh.Path)
+	entries, err := kh.entries(host)
+	return len(entries) > 0, err
+}
+
+// entries returns the known_hosts entries for a host, the same ones Contains
+// matches
+func (kh *knownHosts) entries(host string) ([]string, error) {
+	lines, err := kh.readLines()
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-	defer file.Close()
 
-	normalized := knownhosts.Normalize(host)
+	normalized := normalizeHost(host)
 
 	// There don't appear to be any libraries to parse known_hosts that don't also want to
 	// validate the IP's and host keys. Shelling out to ssh-keygen doesn't support custom ports
@@ -73,80 +610,2703 @@ func (kh *knownHosts) Contains(host string) (bool, error) {
 	// @revoked * ssh-rsa AAAAB5W...
 	// # A CA key, accepted for any host in *.mydomain.com or *.mydomain.org
 	// @cert-authority *.mydomain.org,*.mydomain.com ssh-rsa AAAAB5W...
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		fields := strings.Split(scanner.Text(), " ")
-		if len(fields) != 3 {
+	//
+	// A host matches regardless of the type of key recorded for it, the same
+	// as `ssh-keygen -F`, so hosts aren't re-scanned when the configured key
+	// types change. Entries may have a trailing comment, like the one the
+	// agent adds. A @cert-authority entry whose patterns match the host covers
+	// it too, as its host certificate is trusted. Hostnames are patterns the
+	// same as ssh matches them, so an entry for *.example.com covers
+	// git.example.com and the host isn't scanned again.
+	var entries []string
+
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) >= 4 && fields[0] == "@cert-authority" {
+			if knownHostsPatternsMatch(fields[1], normalized) {
+				entries = append(entries, line)
+			}
 			continue
 		}
-		for _, addr := range strings.Split(fields[0], ",") {
-			if addr == normalized || addr == knownhosts.HashHostname(normalized) {
-				return true, nil
-			}
+		if len(fields) < 3 || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "@") {
+			continue
+		}
+		if knownHostsPatternsMatch(fields[0], normalized) {
+			entries = append(entries, line)
 		}
 	}
 
-	return false, nil
+	return entries, nil
 }
 
-func (kh *knownHosts) Add(host string) error {
-	// Use a lockfile to prevent parallel processes stepping on each other
-	lock, err := kh.Shell.LockFile(kh.Path+".lock", time.Second*30)
+// cidrEntries returns the known_hosts entries with a CIDR block covering host,
+// e.g. 10.0.0.0/24 for 10.0.0.5 or [10.0.0.0/24]:2222 for [10.0.0.5]:2222.
+// ssh doesn't understand CIDR blocks, so unlike the entries Contains matches
+// these don't mean the host is known, but their keys can be trusted for it.
+func (kh *knownHosts) cidrEntries(host string) ([]string, error) {
+	lines, err := kh.readLines()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer func() {
-		if err := lock.Unlock(); err != nil {
-			kh.Shell.Warningf("Failed to release known_hosts file lock: %#v", err)
+
+	normalized := normalizeHost(host)
+
+	var entries []string
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "@") {
+			continue
 		}
-	}()
+		if knownHostsCIDRMatch(fields[0], normalized) {
+			entries = append(entries, line)
+		}
+	}
 
-	// If the keygen output already contains the host, we can skip!
-	if contains, _ := kh.Contains(host); contains {
-		kh.Shell.Commentf("Host %q already in list of known hosts at \"%s\"", host, kh.Path)
-		return nil
+	return entries, nil
+}
+
+// entryFingerprints returns the key types and SHA256 fingerprints of
+// known_hosts entries, e.g. "ssh-ed25519 SHA256:...", skipping any that can't
+// be parsed
+func entryFingerprints(entries []string) []string {
+	var fingerprints []string
+
+	for _, entry := range entries {
+		marker, _, key, _, _, err := ssh.ParseKnownHosts([]byte(entry))
+		if err != nil {
+			continue
+		}
+		fingerprint := key.Type() + " " + ssh.FingerprintSHA256(key)
+		if marker != "" {
+			fingerprint = "@" + marker + " " + fingerprint
+		}
+		fingerprints = append(fingerprints, fingerprint)
+	}
+
+	return fingerprints
+}
+
+// Add adds a host to known_hosts if it's not already there, returning whether
+// any entries were written for it. The host is resolved through the user's ssh
+// config first, so an alias is scanned at the HostName and Port it points to,
+// and its keys are recorded under the name OpenSSH will look them up by.
+func (kh *knownHosts) Add(host string) (bool, error) {
+	target := kh.resolve(host)
+
+	if kh.cached(target.Name) {
+		kh.Shell.Commentf("Host %q already in list of known hosts at \"%s\"", target.Name, kh.Path)
+		return false, nil
+	}
+
+	if kh.ReadOnly {
+		return false, kh.verifyPresent(target)
+	}
+
+	// Only the lock and writes need known_hosts to be writable, so check for
+	// the host first
+	if status, err := kh.present(target.Name); err == nil && status == knownHostsPresent {
+		return false, kh.verifyKnown(target)
+	}
+
+	start := time.Now()
+	unlock, err := kh.lock()
+	if err != nil {
+		if kh.readOnly(target.Name, err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer unlock()
+	kh.timed(knownHostsPhaseLock, target.Name, start)
+
+	added, err := kh.add(target)
+	if kh.readOnly(target.Name, err) {
+		return false, nil
+	}
+	return added, err
+}
+
+// Remove removes a host's entries from known_hosts, including hashed entries,
+// returning whether any were removed
+func (kh *knownHosts) Remove(host string) (bool, error) {
+	if mode := kh.unwritable(); mode != "" {
+		kh.Shell.Commentf("Would remove host %q from known hosts at \"%s\" (%s)", host, kh.Path, mode)
+		return false, nil
 	}
 
-	// Scan the key and then write it to the known_host file
-	keyscanOutput, err := sshKeyScan(kh.Shell, host)
+	unlock, err := kh.lock()
 	if err != nil {
-		return errors.Wrap(err, "Could not perform `ssh-keyscan`")
+		return false, err
 	}
+	defer unlock()
 
-	kh.Shell.Commentf("Added host %q to known hosts at \"%s\"", host, kh.Path)
+	kh.forget(host)
 
-	// Try and open the existing hostfile in (append_only) mode
-	f, err := os.OpenFile(kh.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0700)
+	if err := kh.beforeChange(knownHostsOpRemove, host); err != nil {
+		return false, err
+	}
+
+	removed, err := kh.removeHost(host, false)
 	if err != nil {
-		return errors.Wrapf(err, "Could not open %q for appending", kh.Path)
+		return false, errors.Wrapf(err, "Failed to remove `%s` from known_hosts file", host)
 	}
-	defer f.Close()
 
-	if _, err = fmt.Fprintf(f, "%s\n", keyscanOutput); err != nil {
-		return errors.Wrapf(err, "Could not write to %q", kh.Path)
+	if removed > 0 {
+		kh.Shell.Commentf("Removed host %q from known hosts at \"%s\"", host, kh.Path)
+		kh.changed(knownHostsOpRemove, host)
 	}
 
-	return nil
+	return removed > 0, nil
 }
 
-// AddFromRepository takes a git repo url, extracts the host and adds it
-func (kh *knownHosts) AddFromRepository(repository string) error {
-	u, err := parseGittableURL(repository)
-	if err != nil {
-		kh.Shell.Warningf("Could not parse %q as a URL - skipping adding host to SSH known_hosts", repository)
-		return err
+// unwritable returns why known_hosts mustn't be changed, a dry run or it only
+// being read, or is empty if it can be. Changes that rewrite the file check it
+// before taking the lock, as lock doesn't take one for a dry run.
+func (kh *knownHosts) unwritable() string {
+	switch {
+	case kh.DryRun:
+		return "dry run"
+	case kh.ReadOnly:
+		return "read-only"
+	default:
+		return ""
 	}
+}
 
-	// We only need to keyscan ssh repository urls
-	if u.Scheme != "ssh" {
-		return nil
+// AddMany adds several hosts to known_hosts, acquiring the lock only once, and
+// returns what happened to each of them. Duplicate hosts are only checked,
+// scanned and reported once. Hosts are scanned concurrently, up to
+// ScanConcurrency at a time, and then written in the order they were given so
+// the file is the same regardless of how long scans take.
+//
+// A host that fails to be added doesn't stop the rest, its error is recorded
+// in its result and every host is still tried.
+func (kh *knownHosts) AddMany(hosts []string) knownHostsResults {
+	var results knownHostsResults
+	var targets []sshHost
+	seen := map[string]bool{}
+
+	// The file is read once for the hosts' checks, rather than for each,
+	// unless it's already been read by Open
+	if kh.snapshot == nil {
+		kh.loadSnapshot()
+		defer kh.dropSnapshot()
+	}
+
+	for _, host := range hosts {
+		target := kh.resolve(host)
+		normalized := normalizeHost(target.Name)
+		if seen[normalized] {
+			continue
+		}
+		seen[normalized] = true
+		results = append(results, knownHostsResult{Host: target.Name})
+		targets = append(targets, target)
+	}
+
+	// Only hosts that aren't known yet need the lock
+	var uncached []int
+	for i, target := range targets {
+		if kh.cached(target.Name) {
+			kh.Shell.Commentf("Host %q already in list of known hosts at \"%s\"", target.Name, kh.Path)
+			results[i].Status = knownHostsPresent
+			continue
+		}
+		if kh.ReadOnly {
+			results[i].Status = knownHostsPresent
+			if err := kh.verifyPresent(target); err != nil {
+				results[i].Status, results[i].Err = knownHostsFailed, err
+			}
+			continue
+		}
+		if status, err := kh.present(target.Name); err == nil && status == knownHostsPresent {
+			results[i].Status = knownHostsPresent
+			if err := kh.verifyKnown(target); err != nil {
+				results[i].Status, results[i].Err = knownHostsFailed, err
+			}
+			continue
+		}
+		uncached = append(uncached, i)
+	}
+
+	// Don't take the lock at all if every host is already known
+	if len(uncached) == 0 {
+		return results
+	}
+
+	start := time.Now()
+	unlock, err := kh.lock()
+	if err != nil {
+		for _, i := range uncached {
+			if kh.readOnly(results[i].Host, err) {
+				results[i].Status = knownHostsSkipped
+			} else {
+				results[i].Status, results[i].Err = knownHostsFailed, err
+			}
+		}
+		return results
 	}
+	defer unlock()
+	kh.timed(knownHostsPhaseLock, "", start)
 
-	host := resolveGitHost(kh.Shell, u.Host)
+	// Other processes may have changed the file while we waited for the lock,
+	// and nothing can change it now that we hold it
+	if kh.closer == nil {
+		kh.loadSnapshot()
+	}
 
-	if err = kh.Add(host); err != nil {
-		return errors.Wrapf(err, "Failed to add `%s` to known_hosts file `%s`", host, u)
+	type pendingHost struct {
+		result   *knownHostsResult
+		target   sshHost
+		status   knownHostsStatus
+		keys     string
+		err      error
+		scanTime time.Duration
 	}
 
-	return nil
+	var pending []*pendingHost
+
+	for _, i := range uncached {
+		result := &results[i]
+		host := result.Host
+
+		start := time.Now()
+		status, err := kh.check(host)
+		kh.timed(knownHostsPhaseCheck, host, start)
+		switch {
+		case kh.readOnly(host, err):
+			result.Status = knownHostsSkipped
+		case err != nil:
+			result.Status, result.Err = knownHostsFailed, errors.Wrapf(err, "Failed to add `%s` to known_hosts file", host)
+		case status == knownHostsMissing || status == knownHostsExpired || status == knownHostsIncomplete:
+			pending = append(pending, &pendingHost{result: result, target: targets[i], status: status})
+		default:
+			result.Status = status
+		}
+	}
+
+	concurrency := kh.ScanConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultKnownHostsScanConcurrency
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+
+	for _, p := range pending {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(p *pendingHost) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			start := time.Now()
+			if p.status == knownHostsIncomplete {
+				p.keys, p.err = kh.scanMissing(p.target)
+			} else {
+				p.keys, p.err = kh.scan(p.target)
+			}
+			p.scanTime = time.Since(start)
+		}(p)
+	}
+
+	wg.Wait()
+
+	for _, p := range pending {
+		host := p.result.Host
+
+		// Scan timings are reported here rather than from the scans, so
+		// OnTiming is never called concurrently
+		kh.report(knownHostsPhaseScan, host, p.scanTime)
+
+		// A host that doesn't offer any of its missing key types is left as
+		// it is
+		if p.err == nil && p.keys == "" {
+			kh.remember(host)
+			p.result.Status = knownHostsPresent
+			continue
+		}
+
+		err := p.err
+		if err == nil {
+			start := time.Now()
+			err = kh.write(host, p.keys, p.status)
+			kh.timed(knownHostsPhaseWrite, host, start)
+		}
+
+		switch {
+		case err == nil && p.status == knownHostsExpired:
+			p.result.Status = knownHostsRefreshed
+		case err == nil:
+			p.result.Status = knownHostsAdded
+		case kh.readOnly(host, err):
+			p.result.Status = knownHostsSkipped
+		default:
+			p.result.Status, p.result.Err = knownHostsFailed, errors.Wrapf(err, "Failed to add `%s` to known_hosts file", host)
+		}
+	}
+
+	return results
+}
+
+// knownHostsStatus is the state of a host in known_hosts, from checking it or
+// from trying to add it
+type knownHostsStatus string
+
+const (
+	// The host was already in known_hosts, so nothing was written
+	knownHostsPresent knownHostsStatus = "present"
+
+	// The host wasn't in known_hosts and its entries have been written
+	knownHostsAdded knownHostsStatus = "added"
+
+	// The host's entries had expired and have been replaced
+	knownHostsRefreshed knownHostsStatus = "refreshed"
+
+	// The host wasn't added, but not because of an error, e.g. in a dry run or
+	// as known_hosts is read-only
+	knownHostsSkipped knownHostsStatus = "skipped"
+
+	// The host couldn't be added
+	knownHostsFailed knownHostsStatus = "failed"
+
+	// The host isn't in known_hosts, so needs to be scanned and added
+	knownHostsMissing knownHostsStatus = "missing"
+
+	// The host's entries have expired, so it needs to be scanned again
+	knownHostsExpired knownHostsStatus = "expired"
+
+	// The host is in known_hosts, but has no entries for some of the key
+	// types it's scanned for, so it needs to be scanned for them
+	knownHostsIncomplete knownHostsStatus = "incomplete"
+)
+
+// knownHostsResult is what happened to a host given to AddMany
+type knownHostsResult struct {
+	Host   string
+	Status knownHostsStatus
+
+	// Why the host couldn't be added, if it failed
+	Err error
+}
+
+// knownHostsResults are what happened to each of the hosts given to AddMany,
+// in the order they were given
+type knownHostsResults []knownHostsResult
+
+// Added returns the hosts whose entries were written, either because they
+// were new or refreshed
+func (r knownHostsResults) Added() []string {
+	var added []string
+	for _, result := range r {
+		if result.Status == knownHostsAdded || result.Status == knownHostsRefreshed {
+			added = append(added, result.Host)
+		}
+	}
+	return added
+}
+
+// Err returns the errors of the hosts that failed to be added, or nil if none
+// did. An untrusted host key is returned on its own, as it fails the checkout
+// rather than just being warned about.
+func (r knownHostsResults) Err() error {
+	var errs []error
+	for _, result := range r {
+		if result.Err == nil {
+			continue
+		}
+		if isHostKeyError(result.Err) {
+			return result.Err
+		}
+		errs = append(errs, result.Err)
+	}
+	return combineKnownHostsErrors(errs)
+}
+
+// String summarises how many hosts ended up in each state, e.g. "1 added, 2
+// present"
+func (r knownHostsResults) String() string {
+	counts := map[knownHostsStatus]int{}
+	for _, result := range r {
+		counts[result.Status]++
+	}
+
+	var parts []string
+	for _, status := range []knownHostsStatus{knownHostsAdded, knownHostsRefreshed, knownHostsPresent, knownHostsSkipped, knownHostsFailed} {
+		if counts[status] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[status], status))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// knownHostsErrors are the errors from adding several hosts to known_hosts
+type knownHostsErrors []error
+
+func (e knownHostsErrors) Error() string {
+	var messages []string
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return fmt.Sprintf("%d hosts failed to be added: %s", len(e), strings.Join(messages, "; "))
+}
+
+// combineKnownHostsErrors returns nil if there weren't any errors, the error
+// itself if there was only one, and otherwise all of them as knownHostsErrors
+func combineKnownHostsErrors(errs []error) error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	default:
+		return knownHostsErrors(errs)
+	}
+}
+
+// lock acquires the known_hosts file lock, returning a func to release it that
+// should be deferred straight away. A dry run doesn't write anything, so
+// there's nothing to lock, and while known_hosts is open the lock is already
+// held.
+func (kh *knownHosts) lock() (func(), error) {
+	// It's already held until Close is called
+	if kh.closer != nil {
+		return func() {}, nil
+	}
+
+	if kh.DryRun {
+		return func() {}, nil
+	}
+
+	lockTimeout := kh.LockTimeout
+	if lockTimeout <= 0 {
+		lockTimeout = time.Second * 30
+	}
+
+	if kh.Locker == nil {
+		kh.Locker = &fileLocker{Shell: kh.Shell, Path: kh.Path + ".lock", Context: kh.Context}
+	}
+	lock := kh.Locker
+
+	// Don't touch the lock at all if we've already been cancelled
+	if kh.Context != nil && kh.Context.Err() != nil {
+		return nil, errors.Wrapf(kh.Context.Err(), "Cancelled waiting for a lock on %q", kh.Path)
+	}
+
+	// Use a lock to prevent parallel processes stepping on each other
+	lockStart := time.Now()
+	if kh.LockFailFast {
+		if err := lock.TryLock(); err != nil {
+			return nil, errors.Wrapf(err, "Could not acquire a lock on %q%s, and not waiting for it as fail fast is set", kh.Path, lockHolder(lock))
+		}
+	} else if err := lock.Lock(lockTimeout); err == context.Canceled || (err != nil && kh.Context != nil && kh.Context.Err() != nil) {
+		return nil, errors.Wrapf(err, "Cancelled waiting for a lock on %q", kh.Path)
+	} else if err != nil {
+		waited := time.Since(lockStart).Round(time.Millisecond)
+		return nil, errors.Wrapf(err, "Could not acquire a lock on %q after waiting %v%s", kh.Path, waited, lockHolder(lock))
+	}
+	if waited := time.Since(lockStart); waited >= time.Second {
+		kh.Shell.Commentf("Acquired known_hosts file lock after %v", waited.Round(time.Millisecond))
+	}
+
+	// The lock is released by a deferred call to this, so it's released on
+	// every path out of the caller, even a panic. It's safe to call more than
+	// once, e.g. to release the lock early.
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if err := lock.Unlock(); err != nil {
+				kh.Shell.Warningf("Failed to release known_hosts file lock: %#v", err)
+			}
+
+			changes := kh.changes
+			kh.changes = nil
+			for _, change := range changes {
+				kh.AfterChange(change)
+			}
+		})
+	}, nil
+}
+
+// Open takes the known_hosts lock and holds it until Close is called, so a
+// sequence of Add, Contains and Remove calls is made under one lock rather
+// than each taking it. Nothing else can change known_hosts while it's held, so
+// it's read once and checks are answered from memory. Changes are reported to
+// AfterChange once it's closed. A read-only known_hosts is never locked, and
+// Open only marks it as open.
+func (kh *knownHosts) Open() error {
+	if kh.closer != nil {
+		return fmt.Errorf("Known hosts at %q is already open", kh.Path)
+	}
+
+	if kh.ReadOnly {
+		kh.closer = func() {}
+		return nil
+	}
+
+	unlock, err := kh.lock()
+	if err != nil {
+		return err
+	}
+
+	// A dry run doesn't hold a real lock, so other processes can still
+	// change the file
+	if !kh.DryRun {
+		kh.loadSnapshot()
+	}
+
+	kh.closer = func() {
+		kh.dropSnapshot()
+		unlock()
+	}
+	return nil
+}
+
+// Close releases the lock taken by Open. It's an error if known_hosts isn't
+// open.
+func (kh *knownHosts) Close() error {
+	if kh.closer == nil {
+		return fmt.Errorf("Known hosts at %q isn't open", kh.Path)
+	}
+
+	closer := kh.closer
+	kh.closer = nil
+	closer()
+	return nil
+}
+
+// add adds a resolved host to known_hosts if it's not already there, returning
+// whether any entries were written for it. The lock must already be held.
+func (kh *knownHosts) add(target sshHost) (bool, error) {
+	host := target.Name
+
+	start := time.Now()
+	status, err := kh.check(host)
+	kh.timed(knownHostsPhaseCheck, host, start)
+	if err != nil {
+		return false, err
+	}
+
+	switch status {
+	case knownHostsMissing, knownHostsExpired, knownHostsIncomplete:
+	default:
+		// A certificate authority or CIDR block's entries may have been
+		// added for it instead of scanning it
+		return status == knownHostsAdded, nil
+	}
+
+	scan := kh.scan
+	if status == knownHostsIncomplete {
+		scan = kh.scanMissing
+	}
+
+	start = time.Now()
+	keyscanOutput, err := scan(target)
+	kh.timed(knownHostsPhaseScan, host, start)
+	if err != nil {
+		return false, err
+	}
+
+	// A host that doesn't offer any of its missing key types is left as it is
+	if keyscanOutput == "" {
+		kh.remember(host)
+		return false, nil
+	}
+
+	start = time.Now()
+	defer kh.timed(knownHostsPhaseWrite, host, start)
+
+	if err := kh.write(host, keyscanOutput, status); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// check returns the state of a host in known_hosts, which is missing, expired
+// or incomplete if it needs to be scanned. A host signed by a certificate authority has the
+// CA's entry added instead. The lock must already be held.
+func (kh *knownHosts) check(host string) (knownHostsStatus, error) {
+	status, err := kh.present(host)
+	if err != nil {
+		return "", err
+	}
+
+	switch status {
+	case knownHostsPresent:
+		return knownHostsPresent, nil
+	case knownHostsIncomplete:
+		return kh.checkIncomplete(host)
+	}
+	contains := status == knownHostsExpired
+
+	if ca, ok := kh.certAuthorityFor(host); ok {
+		if err := kh.addCertAuthority(host, ca); err != nil {
+			return "", err
+		} else if kh.DryRun {
+			return knownHostsSkipped, nil
+		}
+		return knownHostsAdded, nil
+	}
+
+	// The keys of a CIDR block the host is in are trusted for it, but need to
+	// be added under its own name for ssh to find them
+	if !contains {
+		cidr, err := kh.cidrEntries(host)
+		if err != nil && !os.IsNotExist(err) {
+			return "", errors.Wrapf(err, "Could not check for host %q in %q", host, kh.Path)
+		}
+		if len(cidr) > 0 {
+			return kh.addFromCIDR(host, cidr)
+		}
+	}
+
+	if kh.Offline {
+		if contains {
+			kh.Shell.Commentf("Host %q in known hosts at \"%s\" is older than %v, but hosts aren't scanned offline", host, kh.Path, kh.TTL)
+			kh.remember(host)
+			return knownHostsPresent, nil
+		}
+		return "", fmt.Errorf("Host %q isn't in known hosts at %q, and hosts aren't scanned offline", host, kh.Path)
+	}
+
+	if err := kh.scanAllowed(host); err != nil {
+		return "", err
+	}
+
+	if kh.DryRun {
+		kh.Shell.Commentf("Would scan host %q and add it to known hosts at \"%s\" (dry run)", host, kh.Path)
+		return knownHostsSkipped, nil
+	}
+
+	if contains {
+		kh.Shell.Commentf("Host %q in known hosts at \"%s\" is older than %v, refreshing it", host, kh.Path, kh.TTL)
+		return knownHostsExpired, nil
+	}
+
+	return knownHostsMissing, nil
+}
+
+// present returns the state of a host's entries in known_hosts, which is
+// missing if it has none, expired if they're due to be refreshed, incomplete
+// if some of the key types it's scanned for are missing, or otherwise present,
+// in which case the host is remembered. It only reads the file, so it can be
+// used without the lock, e.g. when known_hosts is read-only.
+func (kh *knownHosts) present(host string) (knownHostsStatus, error) {
+	// If known_hosts already contains the host, we can skip! A missing file
+	// just means the host isn't there yet, anything else is a real error.
+	entries, err := kh.entries(host)
+	if err != nil && !os.IsNotExist(err) {
+		return "", errors.Wrapf(err, "Could not check for host %q in %q", host, kh.Path)
+	}
+
+	switch {
+	case len(entries) == 0:
+		return knownHostsMissing, nil
+	case kh.expired(host):
+		return knownHostsExpired, nil
+	case len(kh.missingKeyTypes(host, entries)) > 0:
+		return knownHostsIncomplete, nil
+	}
+
+	// The fingerprints show which keys are trusted, e.g. when a host's keys
+	// may have been rotated
+	kh.Shell.Commentf("Host %q already in list of known hosts at \"%s\" (%s)", host, kh.Path, strings.Join(entryFingerprints(entries), ", "))
+	kh.remember(host)
+	return knownHostsPresent, nil
+}
+
+// missingKeyTypes returns the key types a host is scanned for that it has no
+// entries for, if ScanMissingKeyTypes is set. Hosts trusted through a
+// certificate authority or pinned to fingerprints are never missing any, as
+// those decide which of their keys are trusted.
+func (kh *knownHosts) missingKeyTypes(host string, entries []string) []string {
+	if !kh.ScanMissingKeyTypes {
+		return nil
+	}
+	if _, ok := kh.Fingerprints[normalizeHost(host)]; ok {
+		return nil
+	}
+	if _, ok := kh.certAuthorityFor(host); ok {
+		return nil
+	}
+
+	known := map[string]bool{}
+	for _, entry := range entries {
+		marker, _, key, _, _, err := ssh.ParseKnownHosts([]byte(entry))
+		if err != nil {
+			continue
+		}
+		if marker == "cert-authority" {
+			return nil
+		} else if marker != "" {
+			continue
+		}
+		known[sshKeyType(key.Type())] = true
+	}
+
+	keyTypes := kh.Scan.keyTypes()
+	if hostKeyTypes, _, ok := kh.keyTypesFor(host); ok {
+		keyTypes = hostKeyTypes
+	}
+
+	var missing []string
+	for _, keyType := range keyTypes {
+		if !known[keyType] {
+			missing = append(missing, keyType)
+		}
+	}
+
+	return missing
+}
+
+// checkIncomplete returns whether a host that's missing some key types can be
+// scanned for them. The host is already trusted, so if it can't be, e.g. when
+// offline, it's left as it is.
+func (kh *knownHosts) checkIncomplete(host string) (knownHostsStatus, error) {
+	if kh.Offline {
+		kh.remember(host)
+		return knownHostsPresent, nil
+	}
+
+	if err := kh.scanAllowed(host); err != nil {
+		kh.Shell.Commentf("Host %q in known hosts at \"%s\" isn't scanned for its missing key types: %v", host, kh.Path, err)
+		kh.remember(host)
+		return knownHostsPresent, nil
+	}
+
+	if kh.DryRun {
+		kh.Shell.Commentf("Would scan host %q for its missing key types and add them to known hosts at \"%s\" (dry run)", host, kh.Path)
+		return knownHostsSkipped, nil
+	}
+
+	return knownHostsIncomplete, nil
+}
+
+// verifyPresent returns an error if a host isn't in known_hosts, without taking
+// the lock or changing the file, for ReadOnly. Entries that would otherwise be
+// refreshed or completed are still trusted.
+func (kh *knownHosts) verifyPresent(target sshHost) error {
+	host := target.Name
+
+	status, err := kh.present(host)
+	if err != nil {
+		return err
+	}
+
+	switch status {
+	case knownHostsMissing:
+		return fmt.Errorf("Host %q isn't in known hosts at %q, and it's only read rather than written", host, kh.Path)
+	case knownHostsExpired, knownHostsIncomplete:
+		kh.Shell.Commentf("Host %q already in list of known hosts at \"%s\", which is only read rather than written, so its entries are left as they are", host, kh.Path)
+		kh.remember(host)
+	}
+
+	return kh.verifyKnown(target)
+}
+
+// readOnly returns whether err is from known_hosts being on a read-only
+// filesystem, warning that host couldn't be added if it is. If the host's keys
+// are baked into an image this way they should be pre-seeded, so failing the
+// checkout wouldn't help.
+func (kh *knownHosts) readOnly(host string, err error) bool {
+	if !errors.Is(err, syscall.EROFS) {
+		return false
+	}
+
+	kh.Shell.Warningf("Couldn't add host %q to known hosts at \"%s\", as it's on a read-only filesystem (%v). "+
+		"Pre-seed the host's keys into it when the image is built, or use --ssh-known-hosts-path to keep known_hosts somewhere writable", host, kh.Path, err)
+	return true
+}
+
+// certAuthorityFor returns the configured CA whose patterns match a host, if
+// there is one
+func (kh *knownHosts) certAuthorityFor(host string) (knownHostsCertAuthority, bool) {
+	normalized := normalizeHost(host)
+
+	for _, ca := range kh.CertAuthorities {
+		if knownHostsPatternsMatch(ca.Patterns, normalized) {
+			return ca, true
+		}
+	}
+
+	return knownHostsCertAuthority{}, false
+}
+
+// addCertAuthority writes a @cert-authority entry for a CA, instead of scanning
+// a host it signs the certificate of. The lock must already be held.
+func (kh *knownHosts) addCertAuthority(host string, ca knownHostsCertAuthority) error {
+	if kh.DryRun {
+		kh.Shell.Commentf("Would add certificate authority for %q to known hosts at \"%s\" for host %q (dry run)", ca.Patterns, kh.Path, host)
+		return nil
+	}
+
+	if err := kh.beforeChange(knownHostsOpAdd, host); err != nil {
+		return err
+	}
+
+	if err := kh.append(ca.line()); err != nil {
+		return err
+	}
+
+	kh.Shell.Commentf("Added certificate authority for %q to known hosts at \"%s\" for host %q", ca.Patterns, kh.Path, host)
+	kh.remember(host)
+	kh.changed(knownHostsOpAdd, host)
+
+	return nil
+}
+
+// addFromCIDR adds entries for a host with the keys of the CIDR block entries
+// that cover it, instead of scanning it. The lock must already be held.
+func (kh *knownHosts) addFromCIDR(host string, entries []string) (knownHostsStatus, error) {
+	block := strings.Fields(entries[0])[0]
+
+	if kh.DryRun {
+		kh.Shell.Commentf("Would add host %q to known hosts at \"%s\" with the keys for %q (dry run)", host, kh.Path, block)
+		return knownHostsSkipped, nil
+	}
+
+	// Only the host and key are kept, the agent adds its own comment
+	var lines []string
+	for _, entry := range entries {
+		lines = append(lines, strings.Join(strings.Fields(entry)[:3], " "))
+	}
+
+	kh.Shell.Commentf("Host %q is covered by %q in known hosts at \"%s\", so its keys are trusted rather than scanned", host, block, kh.Path)
+	verified, err := kh.verifyFingerprints(host, renameKnownHostsLines(strings.Join(lines, "\n"), host))
+	if err != nil {
+		return "", err
+	}
+	if err := kh.write(host, verified, knownHostsMissing); err != nil {
+		return "", err
+	}
+
+	return knownHostsAdded, nil
+}
+
+// resolve resolves a host through the user's ssh config, running `ssh -G` with
+// Runner if it's set
+func (kh *knownHosts) resolve(host string) sshHost {
+	if kh.Runner == nil {
+		return resolveGitHost(kh.Shell, host)
+	}
+
+	output, err := kh.Runner.RunAndCapture("ssh", "-G", host)
+	if err != nil {
+		output = ""
+	}
+
+	return parseSSHConfigHost(host, output)
+}
+
+// scanAllowed returns an error if DeniedHosts or AllowedHosts mean host can't
+// be scanned, so a misconfigured pipeline can't trust whatever host it's given.
+// The rule that decided it is logged.
+func (kh *knownHosts) scanAllowed(host string) error {
+	if rule, ok := matchHostPatterns(kh.DeniedHosts, host); ok {
+		return fmt.Errorf("Host %q isn't allowed to be scanned, it matches denied host %q", host, rule)
+	}
+
+	if len(kh.AllowedHosts) == 0 {
+		return nil
+	}
+
+	rule, ok := matchHostPatterns(kh.AllowedHosts, host)
+	if !ok {
+		return fmt.Errorf("Host %q isn't allowed to be scanned, it doesn't match any of the allowed hosts (%s)", host, strings.Join(kh.AllowedHosts, ", "))
+	}
+
+	kh.Shell.Commentf("Host %q is allowed to be scanned, it matches allowed host %q", host, rule)
+	return nil
+}
+
+// keyTypesFor returns the key types to scan a host for, and the pattern in
+// HostKeyTypes that chose them, if any
+func (kh *knownHosts) keyTypesFor(host string) ([]string, string, bool) {
+	for _, hostKeyTypes := range kh.HostKeyTypes {
+		if _, ok := matchHostPatterns([]string{hostKeyTypes.Pattern}, host); ok {
+			return hostKeyTypes.KeyTypes, hostKeyTypes.Pattern, true
+		}
+	}
+	return nil, "", false
+}
+
+// matchHostPatterns returns the first of the patterns that matches host, if
+// any. Patterns can use * and ? wildcards like ssh_config, so *.example.com
+// matches any subdomain of example.com. A pattern without a port matches the
+// host on any port.
+func matchHostPatterns(patterns []string, host string) (string, bool) {
+	host = strings.ToLower(host)
+	hostname, _ := splitHostPort(host)
+
+	for _, pattern := range patterns {
+		target := host
+		if _, port := splitHostPort(pattern); port == "" {
+			target = hostname
+		}
+		if wildcardMatch(strings.ToLower(pattern), target) {
+			return pattern, true
+		}
+	}
+
+	return "", false
+}
+
+// scan fetches the host keys for a resolved host from its address, keeping
+// only those that match its expected fingerprints, and returns them recorded
+// under its name. It doesn't touch the known_hosts file, so hosts can be
+// scanned concurrently.
+func (kh *knownHosts) scan(target sshHost) (string, error) {
+	config := kh.Scan
+	if keyTypes, pattern, ok := kh.keyTypesFor(target.Name); ok {
+		kh.Shell.Commentf("Scanning host %q for %s keys, it matches %q", target.Name, strings.Join(keyTypes, ", "), pattern)
+		config.KeyTypes = keyTypes
+	}
+
+	lines, err := kh.scanWith(target, config)
+	if err != nil || kh.IPs == "" {
+		return lines, err
+	}
+
+	return kh.scanIPs(target, config, lines), nil
+}
+
+// The ways IPs records the addresses a host resolves to
+const (
+	// The host's keys are trusted for its addresses too, without scanning
+	// them
+	knownHostsIPsShared = "shared"
+
+	// Each address is scanned, and keys that are the same as the host's are
+	// shared with it, while any others are recorded for the address alone
+	knownHostsIPsScan = "scan"
+)
+
+// parseKnownHostsIPs checks the way the addresses hosts resolve to are
+// recorded, which can be empty if they aren't
+func parseKnownHostsIPs(mode string) (string, error) {
+	switch mode = strings.ToLower(strings.TrimSpace(mode)); mode {
+	case "", knownHostsIPsShared, knownHostsIPsScan:
+		return mode, nil
+	}
+	return "", fmt.Errorf("Unknown known_hosts IP mode %q, expected shared or scan", mode)
+}
+
+// scanIPs adds entries for the IP addresses a scanned host resolves to, see
+// IPs. A host that can't be resolved, or is already an address, is left as it
+// is, as is an address that can't be scanned.
+func (kh *knownHosts) scanIPs(target sshHost, config sshKeyScanConfig, lines string) string {
+	hostname, port := splitHostPort(target.Addr)
+	if net.ParseIP(hostname) != nil {
+		return lines
+	}
+
+	lookupHost := kh.LookupHost
+	if lookupHost == nil {
+		lookupHost = net.LookupHost
+	}
+
+	addrs, err := lookupHost(hostname)
+	if err != nil {
+		kh.Shell.Warningf("Not recording the IP addresses of host %q, it couldn't be resolved: %v", target.Name, err)
+		return lines
+	}
+
+	// DNS answers behind a load balancer come in any order, but the file
+	// shouldn't depend on it
+	var ips []string
+	seen := map[string]bool{}
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil && !seen[ip.String()] {
+			seen[ip.String()] = true
+			ips = append(ips, ip.String())
+		}
+	}
+	sort.Strings(ips)
+	if len(ips) == 0 {
+		return lines
+	}
+
+	entries := strings.Split(strings.TrimSpace(lines), "\n")
+	for _, ip := range ips {
+		addr := ip
+		if port != "" {
+			addr = net.JoinHostPort(ip, port)
+		}
+		name := normalizeHost(addr)
+
+		if kh.IPs == knownHostsIPsShared {
+			entries = shareKnownHostsLines(entries, name, nil)
+			continue
+		}
+
+		// Scanned under the host's name, so the host's pinned fingerprints
+		// apply to the address too
+		scanned, err := kh.scanWith(sshHost{Addr: addr, Name: target.Name}, config)
+		if err != nil {
+			kh.Shell.Warningf("Not recording IP address %q of host %q: %v", ip, target.Name, err)
+			continue
+		}
+
+		keys := map[string]bool{}
+		for _, line := range strings.Split(strings.TrimSpace(scanned), "\n") {
+			if fields := strings.Fields(line); len(fields) >= 3 {
+				keys[fields[1]+" "+fields[2]] = true
+			}
+		}
+
+		entries = shareKnownHostsLines(entries, name, keys)
+		for _, line := range strings.Split(strings.TrimSpace(scanned), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) >= 3 && !hasKnownHostsKey(entries, fields[1]+" "+fields[2]) {
+				fields[0] = name
+				entries = append(entries, strings.Join(fields, " "))
+			}
+		}
+	}
+
+	kh.Shell.Commentf("Recording IP addresses %s for host %q", strings.Join(ips, ", "), target.Name)
+	return strings.Join(entries, "\n") + "\n"
+}
+
+// shareKnownHostsLines adds name to the hostnames of known_hosts lines, only
+// the lines for the given keys if keys isn't nil
+func shareKnownHostsLines(lines []string, name string, keys map[string]bool) []string {
+	shared := make([]string, 0, len(lines))
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && !strings.HasPrefix(line, "#") && !strings.HasPrefix(line, "@") &&
+			(keys == nil || keys[fields[1]+" "+fields[2]]) {
+			fields[0] += "," + name
+			line = strings.Join(fields, " ")
+		}
+		shared = append(shared, line)
+	}
+	return shared
+}
+
+// hasKnownHostsKey returns whether any known_hosts line is for key, a key type
+// and base64 key
+func hasKnownHostsKey(lines []string, key string) bool {
+	for _, line := range lines {
+		if fields := strings.Fields(line); len(fields) >= 3 && fields[1]+" "+fields[2] == key {
+			return true
+		}
+	}
+	return false
+}
+
+// scanMissing scans a host that's already in known_hosts for the key types it
+// has no entries for, returning only the keys of those types. A host that
+// doesn't offer any of them returns nothing, rather than an error, as it's
+// already trusted.
+func (kh *knownHosts) scanMissing(target sshHost) (string, error) {
+	host := target.Name
+
+	entries, err := kh.entries(host)
+	if err != nil {
+		return "", errors.Wrapf(err, "Could not check for host %q in %q", host, kh.Path)
+	}
+
+	missing := kh.missingKeyTypes(host, entries)
+	if len(missing) == 0 {
+		return "", nil
+	}
+	kh.Shell.Commentf("Host %q in known hosts at \"%s\" has no %s keys, scanning for them", host, kh.Path, strings.Join(missing, ", "))
+
+	// Each missing type needs its own connection, and there's no need to
+	// retry for keys the host may well not have
+	config := kh.Scan
+	config.KeyTypes = missing
+	config.AllKeyTypes = true
+	config.Attempts = 1
+
+	lines, err := kh.scanWith(target, config)
+	if isHostKeyError(err) {
+		return "", err
+	}
+
+	if err == nil {
+		lines = filterKnownHostsKeyTypes(lines, missing)
+	}
+	if err != nil || lines == "" {
+		kh.Shell.Commentf("Host %q doesn't offer any %s keys, leaving it as it is", host, strings.Join(missing, ", "))
+		return "", nil
+	}
+
+	return lines, nil
+}
+
+// scanWith scans a resolved host with a scan config, see scan
+func (kh *knownHosts) scanWith(target sshHost, config sshKeyScanConfig) (string, error) {
+	host := target.Name
+	if config.Runner == nil {
+		config.Runner = kh.Runner
+	}
+
+	// A pinned fingerprint could be for any of the host's keys, not just the
+	// one that would be negotiated
+	if _, ok := kh.Fingerprints[normalizeHost(host)]; ok {
+		config.AllKeyTypes = true
+	}
+
+	keyscanOutput, err := sshHostKeys(kh.Shell, target.Addr, config)
+	if err != nil {
+		return "", errors.Wrap(err, "Could not retrieve host key")
+	}
+
+	if target.Name != target.Addr {
+		keyscanOutput = renameKnownHostsLines(keyscanOutput, target.Name)
+	}
+
+	return kh.verifyFingerprints(host, keyscanOutput)
+}
+
+// filterKnownHostsKeyTypes returns only the known_hosts lines for keys of the
+// given types, as passed to `ssh-keyscan -t`
+func filterKnownHostsKeyTypes(lines string, keyTypes []string) string {
+	wanted := map[string]bool{}
+	for _, keyType := range keyTypes {
+		wanted[keyType] = true
+	}
+
+	var filtered []string
+	for _, line := range strings.Split(strings.TrimSpace(lines), "\n") {
+		_, _, key, _, _, err := ssh.ParseKnownHosts([]byte(line))
+		if err != nil || !wanted[sshKeyType(key.Type())] {
+			continue
+		}
+		filtered = append(filtered, line)
+	}
+
+	if len(filtered) == 0 {
+		return ""
+	}
+	return strings.Join(filtered, "\n") + "\n"
+}
+
+// renameKnownHostsLines replaces the hostnames of known_hosts lines, e.g. with
+// the HostKeyAlias the keys are looked up by
+func renameKnownHostsLines(lines string, name string) string {
+	var renamed []string
+
+	for _, line := range strings.Split(strings.TrimSpace(lines), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "@") {
+			renamed = append(renamed, line)
+			continue
+		}
+		fields[0] = knownhosts.Normalize(name)
+		renamed = append(renamed, strings.Join(fields, " "))
+	}
+
+	return strings.Join(renamed, "\n") + "\n"
+}
+
+// write adds scanned host keys to known_hosts for a host in the given state,
+// replacing its existing entries if they've expired. The lock must already be
+// held.
+func (kh *knownHosts) write(host string, keyscanOutput string, status knownHostsStatus) error {
+	refresh := status == knownHostsExpired
+	names := knownHostsLineNames(keyscanOutput)
+	if kh.Hash {
+		keyscanOutput = hashKnownHostsLines(keyscanOutput)
+	}
+	keyscanOutput = annotateKnownHostsLines(keyscanOutput, time.Now())
+
+	// Record when the host was added, so it can be refreshed once it expires.
+	// Adding missing key types doesn't change when its other keys expire.
+	lines := keyscanOutput
+	if kh.TTL > 0 && status != knownHostsIncomplete {
+		lines = kh.marker(host, time.Now()) + "\n" + lines
+	}
+
+	if err := kh.validate(lines); err != nil {
+		return err
+	}
+
+	op := knownHostsOpAdd
+	if refresh {
+		op = knownHostsOpRefresh
+	}
+	if err := kh.beforeChange(op, host); err != nil {
+		return err
+	}
+
+	// Only remove the old entries once the new ones are known to be good, and
+	// only the ones the agent added, any added by hand are kept
+	if refresh {
+		if _, err := kh.removeHost(host, true); err != nil {
+			return err
+		}
+
+		// Including any addresses recorded with it, see IPs
+		for _, name := range names {
+			if normalizeHost(name) == normalizeHost(host) {
+				continue
+			}
+			if _, err := kh.removeHost(name, true); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := kh.append(lines); err != nil {
+		return err
+	}
+
+	kh.Shell.Commentf("Added host %q to known hosts at \"%s\"", host, kh.Path)
+	kh.remember(host)
+	kh.changed(op, host)
+	kh.warnIfLarge()
+
+	if kh.OnAdd != nil {
+		kh.notifyAdded(host, keyscanOutput)
+	}
+
+	return nil
+}
+
+// warnIfLarge warns if known_hosts has more than WarnLines lines, which usually
+// means something is adding a new host every build, e.g. an ephemeral IP
+// address, and will slow down every check of it
+func (kh *knownHosts) warnIfLarge() {
+	if kh.WarnLines <= 0 {
+		return
+	}
+
+	lines, err := kh.readLines()
+	if err != nil || len(lines) <= kh.WarnLines {
+		return
+	}
+
+	kh.Shell.Warningf("Known hosts at %q has %d lines, more than the %d expected. Something may be adding a new host every build, e.g. an ephemeral IP address. Run `buildkite-agent known-hosts-dump` to see what it trusts and remove the entries that aren't needed, or raise --ssh-known-hosts-warn-lines", kh.Path, len(lines), kh.WarnLines)
+}
+
+// knownHostsLineNames returns the hostnames of known_hosts lines that aren't
+// hashed, e.g. a host and the IP addresses recorded with it
+func knownHostsLineNames(lines string) []string {
+	var names []string
+	seen := map[string]bool{}
+
+	for _, line := range strings.Split(strings.TrimSpace(lines), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "@") {
+			continue
+		}
+		for _, name := range strings.Split(fields[0], ",") {
+			if !seen[name] && !strings.HasPrefix(name, "|") {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+
+	return names
+}
+
+// notifyAdded calls OnAdd for each of the host keys written for a host
+func (kh *knownHosts) notifyAdded(host string, lines string) {
+	now := time.Now().UTC()
+
+	for _, line := range strings.Split(strings.TrimSpace(lines), "\n") {
+		_, _, key, _, _, err := ssh.ParseKnownHosts([]byte(line))
+		if err != nil {
+			continue
+		}
+
+		kh.OnAdd(knownHostsEvent{
+			Time:        now,
+			Path:        kh.Path,
+			Host:        normalizeHost(host),
+			KeyType:     key.Type(),
+			Fingerprint: ssh.FingerprintSHA256(key),
+		})
+	}
+}
+
+// knownHostsAuditLog returns an OnAdd func that appends each event to a file
+// as a line of JSON. Failing to write an event is only a warning.
+func knownHostsAuditLog(sh *shell.Shell, path string) func(knownHostsEvent) {
+	return func(event knownHostsEvent) {
+		data, err := json.Marshal(event)
+		if err != nil {
+			sh.Warningf("Failed to encode known_hosts audit event: %v", err)
+			return
+		}
+
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			sh.Warningf("Failed to open known_hosts audit log %q: %v", path, err)
+			return
+		}
+		defer f.Close()
+
+		if _, err = fmt.Fprintf(f, "%s\n", data); err != nil {
+			sh.Warningf("Failed to write to known_hosts audit log %q: %v", path, err)
+		}
+	}
+}
+
+// PruneManaged removes the entries the agent added to known_hosts, and the
+// markers recording when they were added, leaving entries added by hand. It
+// returns how many entries were removed.
+func (kh *knownHosts) PruneManaged() (int, error) {
+	if mode := kh.unwritable(); mode != "" {
+		kh.Shell.Commentf("Would remove entries added by the agent from known hosts at \"%s\" (%s)", kh.Path, mode)
+		return 0, nil
+	}
+
+	unlock, err := kh.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	lines, err := kh.readLines()
+	if err != nil {
+		return 0, errors.Wrapf(err, "Could not read %q", kh.Path)
+	}
+
+	removed := 0
+	markers := 0
+
+	var kept []string
+	for _, line := range lines {
+		if _, _, ok := parseKnownHostsMarker(line); ok {
+			markers++
+			continue
+		}
+		if isManagedKnownHostsLine(line) {
+			removed++
+			continue
+		}
+		kept = append(kept, line)
+	}
+
+	if removed == 0 && markers == 0 {
+		return 0, nil
+	}
+
+	if err = kh.beforeChange(knownHostsOpPrune, ""); err != nil {
+		return 0, err
+	}
+
+	kh.forgetAll()
+
+	if err = kh.replace(kept); err != nil {
+		return 0, err
+	}
+
+	kh.Shell.Commentf("Removed %d entries added by the agent from known hosts at \"%s\"", removed, kh.Path)
+	kh.changed(knownHostsOpPrune, "")
+	return removed, nil
+}
+
+// Dedup rewrites known_hosts without duplicate entries, keeping the first of
+// each. Entries are duplicates if they're the same apart from whitespace. With
+// coalesce, entries with the same hostnames and key are duplicates even if
+// their comments differ, e.g. an entry added by hand and the same one added by
+// the agent. Comments and markers are kept, and each key type for a host is
+// still a separate entry. It returns how many entries were removed.
+func (kh *knownHosts) Dedup(coalesce bool) (int, error) {
+	if mode := kh.unwritable(); mode != "" {
+		kh.Shell.Commentf("Would remove duplicate entries from known hosts at \"%s\" (%s)", kh.Path, mode)
+		return 0, nil
+	}
+
+	unlock, err := kh.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	lines, err := kh.readLines()
+	if err != nil {
+		return 0, errors.Wrapf(err, "Could not read %q", kh.Path)
+	}
+
+	seen := map[string]bool{}
+	removed := 0
+
+	var kept []string
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			kept = append(kept, line)
+			continue
+		}
+
+		key := strings.Join(fields, " ")
+		if coalesce {
+			key = knownHostsEntryKey(fields)
+		}
+
+		if seen[key] {
+			removed++
+			continue
+		}
+		seen[key] = true
+		kept = append(kept, line)
+	}
+
+	if removed == 0 {
+		return 0, nil
+	}
+
+	if err = kh.beforeChange(knownHostsOpDedup, ""); err != nil {
+		return 0, err
+	}
+
+	if err = kh.replace(kept); err != nil {
+		return 0, err
+	}
+
+	kh.Shell.Commentf("Removed %d duplicate entries from known hosts at \"%s\"", removed, kh.Path)
+	kh.changed(knownHostsOpDedup, "")
+	return removed, nil
+}
+
+// SeedFrom merges the entries from a known_hosts bundle into known_hosts
+// without scanning anything, so hosts can be trusted where they can't be
+// reached. Entries that are already there, ignoring their comments, are
+// skipped, as are comments in the bundle. Nothing is written if any entry in
+// the bundle is malformed. It returns how many entries were added.
+func (kh *knownHosts) SeedFrom(path string) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Could not read known hosts bundle %q", path)
+	}
+
+	var entries []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, _, _, _, _, err := ssh.ParseKnownHosts([]byte(line)); err != nil {
+			return 0, fmt.Errorf("Malformed host key %q in known hosts bundle %q", line, path)
+		}
+		entries = append(entries, line)
+	}
+
+	unlock, err := kh.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	lines, err := kh.readLines()
+	if err != nil && !os.IsNotExist(err) {
+		return 0, errors.Wrapf(err, "Could not read %q", kh.Path)
+	}
+
+	seen := map[string]bool{}
+	for _, line := range lines {
+		if fields := strings.Fields(line); len(fields) > 0 && !strings.HasPrefix(fields[0], "#") {
+			seen[knownHostsEntryKey(fields)] = true
+		}
+	}
+
+	var added []string
+	for _, entry := range entries {
+		key := knownHostsEntryKey(strings.Fields(entry))
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		added = append(added, entry)
+	}
+
+	if len(added) == 0 {
+		kh.Shell.Commentf("All entries in known hosts bundle %q are already in \"%s\"", path, kh.Path)
+		return 0, nil
+	}
+
+	if kh.DryRun {
+		kh.Shell.Commentf("Would add %d entries from known hosts bundle %q to known hosts at \"%s\" (dry run)", len(added), path, kh.Path)
+		return len(added), nil
+	}
+
+	if err = kh.beforeChange(knownHostsOpSeed, ""); err != nil {
+		return 0, err
+	}
+
+	if err = kh.append(strings.Join(added, "\n")); err != nil {
+		return 0, err
+	}
+
+	kh.Shell.Commentf("Added %d entries from known hosts bundle %q to known hosts at \"%s\"", len(added), path, kh.Path)
+	kh.changed(knownHostsOpSeed, "")
+	return len(added), nil
+}
+
+// knownHostsEntryKey returns the parts of a known_hosts entry that identify
+// it, the marker if it has one, the hostnames, and the key type and key,
+// leaving out the comment
+func knownHostsEntryKey(fields []string) string {
+	n := 3
+	if strings.HasPrefix(fields[0], "@") {
+		n = 4
+	}
+	if len(fields) < n {
+		return strings.Join(fields, " ")
+	}
+	return strings.Join(fields[:n], " ")
+}
+
+// hostKeyMismatchError is returned when none of the host keys presented by a
+// host match the fingerprints it was pinned to
+type hostKeyMismatchError struct {
+	Host         string
+	Fingerprints []string
+}
+
+func (e *hostKeyMismatchError) Error() string {
+	return fmt.Sprintf("Host key for %q doesn't match any of the expected fingerprints, got %s",
+		e.Host, strings.Join(e.Fingerprints, ", "))
+}
+
+// hostKeyChangedError is returned when a host that's already in known_hosts
+// presents a different key to the one stored for it
+type hostKeyChangedError struct {
+	Host    string
+	Path    string
+	Known   []string
+	Scanned []string
+}
+
+func (e *hostKeyChangedError) Error() string {
+	return fmt.Sprintf("Host key for %q has changed, known hosts at %q has %s but the host presented %s. "+
+		"Someone could be intercepting the connection, or the host's keys have been rotated, in which case remove its old entries from known_hosts",
+		e.Host, e.Path, strings.Join(e.Known, ", "), strings.Join(e.Scanned, ", "))
+}
+
+// isHostKeyError returns whether err is from a host presenting a key that
+// can't be trusted, which fails the checkout rather than just being warned
+// about
+func isHostKeyError(err error) bool {
+	switch errors.Cause(err).(type) {
+	case *hostKeyMismatchError, *hostKeyChangedError:
+		return true
+	}
+	return false
+}
+
+// verifyKnown scans a host that's already in known_hosts if VerifyKnown is set,
+// returning a hostKeyChangedError if a key it presents differs from the stored
+// key of the same type. Key types only one of them has can't be compared, and
+// a host that can't be scanned is only warned about, as git will fail to
+// connect to it anyway.
+func (kh *knownHosts) verifyKnown(target sshHost) error {
+	if !kh.VerifyKnown || kh.Offline || kh.DryRun {
+		return nil
+	}
+	host := target.Name
+
+	entries, err := kh.entries(host)
+	if err != nil {
+		return errors.Wrapf(err, "Could not check for host %q in %q", host, kh.Path)
+	}
+
+	// Hosts trusted through a certificate authority don't have keys of
+	// their own to compare
+	known := map[string][]string{}
+	for _, entry := range entries {
+		marker, _, key, _, _, err := ssh.ParseKnownHosts([]byte(entry))
+		if err != nil || marker != "" {
+			continue
+		}
+		known[key.Type()] = append(known[key.Type()], ssh.FingerprintSHA256(key))
+	}
+	if len(known) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	lines, err := kh.scan(target)
+	kh.timed(knownHostsPhaseScan, host, start)
+	if isHostKeyError(err) {
+		return err
+	} else if err != nil {
+		kh.Shell.Warningf("Couldn't scan host %q to compare its keys with the ones in known hosts at \"%s\": %v", host, kh.Path, err)
+		return nil
+	}
+
+	var knownFingerprints, scannedFingerprints []string
+	compared := map[string]bool{}
+	changed := false
+
+	for _, line := range strings.Split(strings.TrimSpace(lines), "\n") {
+		_, _, key, _, _, err := ssh.ParseKnownHosts([]byte(line))
+		if err != nil {
+			continue
+		}
+
+		fingerprints, ok := known[key.Type()]
+		if !ok {
+			continue
+		}
+
+		if !compared[key.Type()] {
+			compared[key.Type()] = true
+			for _, f := range fingerprints {
+				knownFingerprints = append(knownFingerprints, key.Type()+" "+f)
+			}
+		}
+
+		fingerprint := ssh.FingerprintSHA256(key)
+		scannedFingerprints = append(scannedFingerprints, key.Type()+" "+fingerprint)
+
+		matched := false
+		for _, f := range fingerprints {
+			if f == fingerprint {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			changed = true
+		}
+	}
+
+	if changed {
+		kh.forget(host)
+		return &hostKeyChangedError{Host: host, Path: kh.Path, Known: knownFingerprints, Scanned: scannedFingerprints}
+	}
+
+	if len(compared) == 0 {
+		kh.Shell.Warningf("Couldn't compare the keys of host %q with the ones in known hosts at \"%s\", as it didn't present any keys of the same types", host, kh.Path)
+		return nil
+	}
+
+	kh.Shell.Commentf("Host %q presented the same keys as the ones in known hosts at \"%s\"", host, kh.Path)
+	return nil
+}
+
+// verifyFingerprints checks scanned known_hosts lines against the fingerprints
+// the host has been pinned to, if any, returning only the lines that match.
+func (kh *knownHosts) verifyFingerprints(host string, lines string) (string, error) {
+	expected, ok := kh.Fingerprints[normalizeHost(host)]
+	if !ok {
+		return lines, nil
+	}
+
+	var verified, fingerprints []string
+
+	for _, line := range strings.Split(strings.TrimSpace(lines), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		_, _, key, _, _, err := ssh.ParseKnownHosts([]byte(line))
+		if err != nil {
+			continue
+		}
+
+		fingerprint := ssh.FingerprintSHA256(key)
+		fingerprints = append(fingerprints, fingerprint)
+
+		for _, e := range expected {
+			if fingerprint == e {
+				verified = append(verified, line)
+				break
+			}
+		}
+	}
+
+	if len(verified) == 0 {
+		return "", &hostKeyMismatchError{Host: host, Fingerprints: fingerprints}
+	}
+
+	return strings.Join(verified, "\n"), nil
+}
+
+// parseHostKeyFingerprints parses host=fingerprint pairs into a map of
+// normalized hosts to their expected fingerprints. Fingerprints are in the
+// SHA256 format that `ssh-keygen -lf` prints, the SHA256: prefix is optional.
+func parseHostKeyFingerprints(pairs []string) (map[string][]string, error) {
+	fingerprints := map[string][]string{}
+
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid host key fingerprint %q, expected host=SHA256:fingerprint", pair)
+		}
+
+		host, fingerprint := normalizeHost(parts[0]), parts[1]
+		if !strings.HasPrefix(fingerprint, "SHA256:") {
+			fingerprint = "SHA256:" + fingerprint
+		}
+
+		fingerprints[host] = append(fingerprints[host], fingerprint)
+	}
+
+	return fingerprints, nil
+}
+
+// parseCertAuthorities parses pattern=key pairs into certificate authorities,
+// where key is a public key, e.g. "ssh-ed25519 AAAA...", or the path to a file
+// containing one. Patterns for the same key are combined into one pattern list.
+func parseCertAuthorities(pairs []string) ([]knownHostsCertAuthority, error) {
+	var authorities []knownHostsCertAuthority
+	index := map[string]int{}
+
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("Invalid certificate authority %q, expected pattern=public key or pattern=path to a public key", pair)
+		}
+
+		pattern, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(value))
+		if err != nil {
+			data, readErr := ioutil.ReadFile(value)
+			if readErr != nil {
+				return nil, fmt.Errorf("Invalid certificate authority %q, %q is neither a public key nor a file that can be read (%v)", pair, value, readErr)
+			}
+			if key, _, _, _, err = ssh.ParseAuthorizedKey(data); err != nil {
+				return nil, fmt.Errorf("Invalid certificate authority %q, %q doesn't contain a public key (%v)", pair, value, err)
+			}
+		}
+
+		marshaled := string(key.Marshal())
+		if i, ok := index[marshaled]; ok {
+			authorities[i].Patterns += "," + pattern
+			continue
+		}
+
+		index[marshaled] = len(authorities)
+		authorities = append(authorities, knownHostsCertAuthority{Patterns: pattern, Key: key})
+	}
+
+	return authorities, nil
+}
+
+// parseHostKeyTypes parses pattern=type pairs into the key types to scan the
+// hosts matching each pattern for, where type is one that `ssh-keyscan -t`
+// accepts. A pattern can be given more than once to scan for several types,
+// and patterns keep the order they're first given in.
+func parseHostKeyTypes(pairs []string) ([]knownHostsKeyTypes, error) {
+	var hostKeyTypes []knownHostsKeyTypes
+	index := map[string]int{}
+
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("Invalid host key type %q, expected pattern=type, e.g. github.com=ed25519", pair)
+		}
+
+		pattern := strings.ToLower(strings.TrimSpace(parts[0]))
+		keyTypes, err := parseSSHKeyTypes([]string{parts[1]})
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid host key type %q", pair)
+		}
+
+		if i, ok := index[pattern]; ok {
+			hostKeyTypes[i].KeyTypes = append(hostKeyTypes[i].KeyTypes, keyTypes...)
+			continue
+		}
+
+		index[pattern] = len(hostKeyTypes)
+		hostKeyTypes = append(hostKeyTypes, knownHostsKeyTypes{Pattern: pattern, KeyTypes: keyTypes})
+	}
+
+	return hostKeyTypes, nil
+}
+
+// useLockDir moves the known_hosts lock into another directory, e.g. a local
+// one when known_hosts is on NFS, where pid lock files aren't reliable
+func (kh *knownHosts) useLockDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrapf(err, "Could not create known_hosts lock directory %q", dir)
+	}
+
+	kh.Locker = &fileLocker{Shell: kh.Shell, Path: knownHostsLockPath(kh.Path, dir), Context: kh.Context}
+	return nil
+}
+
+// useSharedLockDir is like useLockDir, but for a lock that agents running as
+// other users take too, so the directory and the locks in it can be used and
+// reclaimed by all of them
+func (kh *knownHosts) useSharedLockDir(dir string) error {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return errors.Wrapf(err, "Could not create known_hosts lock directory %q", dir)
+	}
+
+	// The umask would otherwise stop other users creating locks in it. It
+	// can't be changed if another user created it, in which case they will
+	// have done so already.
+	if info, err := os.Stat(dir); err == nil && info.Mode().Perm() != 0777 {
+		if err := os.Chmod(dir, 0777); err != nil {
+			kh.Shell.Warningf("Failed to let all users take the known_hosts lock in %q: %v", dir, err)
+		}
+	}
+
+	kh.Locker = &fileLocker{Shell: kh.Shell, Path: knownHostsLockPath(kh.Path, dir), Context: kh.Context, Shared: true}
+	return nil
+}
+
+// knownHostsLockPath returns the path of the lock for a known_hosts file in a
+// lock directory, named after a hash of the file's path so locks for
+// different files don't collide
+func knownHostsLockPath(path string, dir string) string {
+	if absolutePath, err := filepath.Abs(path); err == nil {
+		path = absolutePath
+	}
+
+	sum := sha256.Sum256([]byte(path))
+	return filepath.Join(dir, "buildkite-known-hosts-"+hex.EncodeToString(sum[:8])+".lock")
+}
+
+// knownHostsLocker serializes changes to a known_hosts file between processes
+type knownHostsLocker interface {
+	// Lock waits up to timeout for the lock to be free and acquires it
+	Lock(timeout time.Duration) error
+
+	// TryLock acquires the lock if it's free, without waiting
+	TryLock() error
+
+	// Unlock releases a held lock
+	Unlock() error
+}
+
+// knownHostsLockHolder is implemented by knownHostsLockers that can tell who
+// holds the lock, so that failing to acquire it points at the holder
+type knownHostsLockHolder interface {
+	// Holder describes the process holding the lock, or is empty if it's
+	// not known
+	Holder() string
+}
+
+// lockHolder describes who holds a lock for an error message, or is empty if
+// the locker can't tell
+func lockHolder(lock knownHostsLocker) string {
+	if holder, ok := lock.(knownHostsLockHolder); ok {
+		if desc := holder.Holder(); desc != "" {
+			return "; " + desc
+		}
+	}
+	return ""
+}
+
+// fileLocker is a knownHostsLocker backed by a pid lock file
+type fileLocker struct {
+	Shell *shell.Shell
+	Path  string
+
+	// Stops waiting for the lock when it's done, defaults to the shell's
+	// context
+	Context context.Context
+
+	// Whether agents running as other users take the lock too, so they need
+	// to be able to read who holds it
+	Shared bool
+
+	lock shell.LockFile
+}
+
+func (l *fileLocker) Lock(timeout time.Duration) error {
+	l.noteAbandonedLock()
+
+	ctx := l.Context
+	if ctx == nil {
+		ctx = l.Shell.Context()
+	}
+
+	lock, err := l.Shell.LockFileWithContext(ctx, l.Path, timeout)
+	if err != nil {
+		return err
+	}
+
+	l.lock = lock
+	l.share()
+	return nil
+}
+
+func (l *fileLocker) TryLock() error {
+	l.noteAbandonedLock()
+
+	absolutePath, err := filepath.Abs(l.Path)
+	if err != nil {
+		return fmt.Errorf("Failed to find absolute path to lock %q (%v)", l.Path, err)
+	}
+
+	lock, err := lockfile.New(absolutePath)
+	if err != nil {
+		return fmt.Errorf("Failed to create lock %q (%v)", absolutePath, err)
+	}
+	if err = lock.TryLock(); err != nil {
+		return err
+	}
+
+	l.lock = &lock
+	l.share()
+	return nil
+}
+
+// share lets every user read a shared lock once it's held, as it's created
+// only readable by its owner, and other users need to read the pid in it to
+// tell whether it's held or abandoned
+func (l *fileLocker) share() {
+	if !l.Shared {
+		return
+	}
+	if err := os.Chmod(l.Path, 0644); err != nil {
+		l.Shell.Warningf("Failed to let all users read the known_hosts lock %q: %v", l.Path, err)
+	}
+}
+
+func (l *fileLocker) Unlock() error {
+	if l.lock == nil {
+		return fmt.Errorf("Lock %q isn't held", l.Path)
+	}
+
+	err := l.lock.Unlock()
+	l.lock = nil
+	return err
+}
+
+// Holder reads the pid of the process holding the lock from the lock file, and
+// whether that process still exists
+func (l *fileLocker) Holder() string {
+	content, err := ioutil.ReadFile(l.Path)
+	if err != nil {
+		return ""
+	}
+
+	line := strings.SplitN(string(content), "\n", 2)[0]
+	pid, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil || pid <= 0 {
+		return ""
+	}
+
+	absolutePath, err := filepath.Abs(l.Path)
+	if err != nil {
+		return fmt.Sprintf("lock held by pid %d", pid)
+	}
+
+	switch _, err := lockfile.Lockfile(absolutePath).GetOwner(); err {
+	case nil:
+		return fmt.Sprintf("lock held by running pid %d", pid)
+	case lockfile.ErrDeadOwner:
+		return fmt.Sprintf("lock held by dead pid %d (stale)", pid)
+	default:
+		return fmt.Sprintf("lock held by pid %d", pid)
+	}
+}
+
+// noteAbandonedLock notes when a known_hosts lock was left behind by an agent
+// that was killed while holding it, which the lockfile library then reclaims
+// as its owner has exited. Locks whose owner is still running are never taken
+// over, however old they are, as they may well still be in use, e.g. by a
+// long-lived Open.
+func (l *fileLocker) noteAbandonedLock() {
+	path := l.Path
+
+	if _, err := os.Stat(path); err != nil {
+		return
+	}
+
+	if absolutePath, err := filepath.Abs(path); err == nil {
+		if _, err := lockfile.Lockfile(absolutePath).GetOwner(); err == lockfile.ErrDeadOwner {
+			l.Shell.Commentf("Reclaiming known_hosts lock %q from a process that no longer exists", path)
+		}
+	}
+}
+
+// append validates known_hosts lines and then appends them to the file. Nothing
+// is written if any of the lines are invalid.
+func (kh *knownHosts) append(lines string) error {
+	if err := kh.validate(lines); err != nil {
+		return err
+	}
+
+	if err := kh.file().Append([]byte(strings.TrimSpace(lines) + "\n")); err != nil {
+		return err
+	}
+
+	if kh.snapshot != nil {
+		updated := append([]string{}, kh.snapshot.lines...)
+		kh.snapshot = &knownHostsSnapshot{lines: append(updated, strings.Split(strings.TrimSpace(lines), "\n")...)}
+	}
+	return nil
+}
+
+// file returns where entries are read from and appended to
+func (kh *knownHosts) file() knownHostsFile {
+	if kh.File != nil {
+		return kh.File
+	}
+	return &osKnownHostsFile{Shell: kh.Shell, Path: kh.Path, SyncDir: kh.Fsync}
+}
+
+// knownHostsFile is where known_hosts entries are read from and appended to,
+// so they can be kept in memory in tests
+type knownHostsFile interface {
+	// Open returns the current contents, or an error that satisfies
+	// os.IsNotExist if there aren't any yet
+	Open() (io.ReadCloser, error)
+
+	// Append adds complete lines to the end, all or nothing
+	Append(data []byte) error
+}
+
+// osKnownHostsFile is a knownHostsFile backed by a file on disk
+type osKnownHostsFile struct {
+	Shell *shell.Shell
+	Path  string
+
+	// Whether to fsync the directory the file is in after appending to it
+	SyncDir bool
+}
+
+func (f *osKnownHostsFile) Open() (io.ReadCloser, error) {
+	return os.Open(f.Path)
+}
+
+// Append writes the lines in a single write and syncs them, and if the write
+// fails part way the file is truncated back to how it was, so it's never left
+// with a partial entry
+func (f *osKnownHostsFile) Append(data []byte) error {
+	// Try and open the existing hostfile in (append_only) mode
+	file, err := openKnownHostsForAppend(f.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "Could not stat %q", f.Path)
+	}
+	size := info.Size()
+
+	// Don't join the first entry onto a last line without a newline, e.g. one
+	// added by hand
+	if size > 0 {
+		last := make([]byte, 1)
+		if _, err = file.ReadAt(last, size-1); err != nil {
+			return errors.Wrapf(err, "Could not read %q", f.Path)
+		}
+		if last[0] != '\n' {
+			data = append([]byte("\n"), data...)
+		}
+	}
+
+	// A single write, so Contains never sees a partial entry
+	if n, err := knownHostsWrite(file, data); err != nil || n != len(data) {
+		if err == nil {
+			err = io.ErrShortWrite
+		}
+		if truncateErr := file.Truncate(size); truncateErr != nil {
+			f.Shell.Warningf("Failed to remove partially written entries from %q: %v", f.Path, truncateErr)
+		}
+		return errors.Wrapf(err, "Could not write to %q", f.Path)
+	}
+
+	if err = file.Sync(); err != nil {
+		return errors.Wrapf(err, "Could not sync %q", f.Path)
+	}
+
+	if f.SyncDir {
+		return syncDir(filepath.Dir(f.Path))
+	}
+
+	return nil
+}
+
+// syncDir fsyncs a directory, so the files that were created in it or renamed
+// into it are durable. Windows can't sync a directory, and there's no need to
+// as NTFS journals its metadata.
+func syncDir(path string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	dir, err := os.Open(path)
+	if err != nil {
+		return errors.Wrapf(err, "Could not open directory %q to sync it", path)
+	}
+	defer dir.Close()
+
+	if err := dir.Sync(); err != nil {
+		return errors.Wrapf(err, "Could not sync directory %q", path)
+	}
+
+	return nil
+}
+
+// knownHostsOpenAttempts is how many times opening known_hosts to append to it
+// is tried when it fails because another process briefly has it open
+const knownHostsOpenAttempts = 5
+
+// knownHostsOpenRetryInterval is how long to wait before the first retry,
+// doubling after each attempt, plus up to as long again of jitter so agents
+// sharing a file don't retry in step
+var knownHostsOpenRetryInterval = 50 * time.Millisecond
+
+// knownHostsOpenFile opens known_hosts, it's replaced in tests to simulate
+// failed opens
+var knownHostsOpenFile = os.OpenFile
+
+// openKnownHostsForAppend opens known_hosts for appending, retrying with jitter
+// while it fails with one of knownHostsTransientOpenErrors, e.g. because
+// antivirus on Windows is scanning it
+func openKnownHostsForAppend(path string) (*os.File, error) {
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	interval := knownHostsOpenRetryInterval
+
+	for attempt := 1; ; attempt++ {
+		file, err := knownHostsOpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+		if err == nil {
+			return file, nil
+		}
+
+		if !isTransientOpenError(err) {
+			return nil, errors.Wrapf(err, "Could not open %q for appending", path)
+		}
+		if attempt == knownHostsOpenAttempts {
+			return nil, errors.Wrapf(err, "Could not open %q for appending after %d attempts, another process has it open", path, attempt)
+		}
+
+		time.Sleep(interval + time.Duration(random.Int63n(int64(interval)+1)))
+		interval *= 2
+	}
+}
+
+// isTransientOpenError returns whether opening a file failed with one of
+// knownHostsTransientOpenErrors
+func isTransientOpenError(err error) bool {
+	for _, transient := range knownHostsTransientOpenErrors {
+		if errors.Is(err, transient) {
+			return true
+		}
+	}
+	return false
+}
+
+// knownHostsWrite writes to known_hosts, it's replaced in tests to simulate
+// failed writes
+var knownHostsWrite = func(f *os.File, data []byte) (int, error) {
+	return f.Write(data)
+}
+
+// validate returns an error if known_hosts lines don't contain at least one
+// host key, or any of them are malformed
+func (kh *knownHosts) validate(lines string) error {
+	keys := 0
+
+	for _, line := range strings.Split(strings.TrimSpace(lines), "\n") {
+		if strings.HasPrefix(line, "#") || strings.TrimSpace(line) == "" {
+			continue
+		}
+		if _, _, _, _, _, err := ssh.ParseKnownHosts([]byte(line)); err != nil {
+			return fmt.Errorf("Refusing to write malformed host key %q to %q", line, kh.Path)
+		}
+		keys++
+	}
+
+	if keys == 0 {
+		return fmt.Errorf("Refusing to write empty host key to %q", kh.Path)
+	}
+
+	return nil
+}
+
+// marker returns the comment recording when the agent added a host. The host
+// is hashed when hostnames are, so it isn't revealed by the comment.
+func (kh *knownHosts) marker(host string, at time.Time) string {
+	name := normalizeHost(host)
+	if kh.Hash {
+		name = knownhosts.HashHostname(name)
+	}
+	return fmt.Sprintf("%s%s at %s", knownHostsMarkerPrefix, name, at.UTC().Format(time.RFC3339))
+}
+
+// parseKnownHostsMarker returns the host and time recorded in a marker comment
+func parseKnownHostsMarker(line string) (string, time.Time, bool) {
+	if !strings.HasPrefix(line, knownHostsMarkerPrefix) {
+		return "", time.Time{}, false
+	}
+
+	fields := strings.Fields(strings.TrimPrefix(line, knownHostsMarkerPrefix))
+	if len(fields) != 3 || fields[1] != "at" {
+		return "", time.Time{}, false
+	}
+
+	at, err := time.Parse(time.RFC3339, fields[2])
+	if err != nil {
+		return "", time.Time{}, false
+	}
+
+	return fields[0], at, true
+}
+
+// expired returns whether the entries the agent added for a host are older
+// than the TTL. Entries without a marker, e.g. ones that weren't added by the
+// agent, never expire.
+func (kh *knownHosts) expired(host string) bool {
+	if kh.TTL <= 0 {
+		return false
+	}
+
+	lines, err := kh.readLines()
+	if err != nil {
+		return false
+	}
+
+	normalized := normalizeHost(host)
+
+	var added time.Time
+	for _, line := range lines {
+		if name, at, ok := parseKnownHostsMarker(line); ok && hostMatches(name, normalized) && at.After(added) {
+			added = at
+		}
+	}
+
+	return !added.IsZero() && time.Since(added) > kh.TTL
+}
+
+// removeHost removes a host's entries, and the markers recording when they
+// were added, returning how many entries were removed. Lines listing several
+// hosts are removed entirely, and @cert-authority and @revoked lines are kept.
+// If managedOnly is set, only the entries the agent wrote are removed.
+func (kh *knownHosts) removeHost(host string, managedOnly bool) (int, error) {
+	lines, err := kh.readLines()
+	if err != nil {
+		return 0, errors.Wrapf(err, "Could not read %q", kh.Path)
+	}
+
+	normalized := normalizeHost(host)
+	removed := 0
+
+	var kept []string
+	for _, line := range lines {
+		if name, _, ok := parseKnownHostsMarker(line); ok && hostMatches(name, normalized) {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && !strings.HasPrefix(line, "#") && !strings.HasPrefix(line, "@") &&
+			(!managedOnly || isManagedKnownHostsLine(line)) {
+			matched := false
+			for _, addr := range strings.Split(fields[0], ",") {
+				if hostMatches(addr, normalized) {
+					matched = true
+					break
+				}
+			}
+			if matched {
+				removed++
+				continue
+			}
+		}
+
+		kept = append(kept, line)
+	}
+
+	if removed == 0 {
+		return 0, nil
+	}
+
+	return removed, kh.replace(kept)
+}
+
+// readLines returns the lines of the known_hosts file
+func (kh *knownHosts) readLines() ([]string, error) {
+	if kh.snapshot != nil {
+		return kh.snapshot.lines, kh.snapshot.err
+	}
+
+	file, err := kh.file().Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var lines []string
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	return lines, scanner.Err()
+}
+
+// knownHostsSnapshot is the contents of known_hosts, or why it couldn't be
+// read, at the start of a batch
+type knownHostsSnapshot struct {
+	lines []string
+	err   error
+}
+
+// loadSnapshot reads known_hosts into memory, so that checks for hosts are
+// answered from there until dropSnapshot is called, rather than reading the
+// file each time. The changes the agent makes are applied to it too, but
+// changes from other processes aren't seen, so it should be reloaded once the
+// lock is taken.
+func (kh *knownHosts) loadSnapshot() {
+	kh.snapshot = nil
+	lines, err := kh.readLines()
+	kh.snapshot = &knownHostsSnapshot{lines: lines, err: err}
+}
+
+// dropSnapshot goes back to reading known_hosts for each check
+func (kh *knownHosts) dropSnapshot() {
+	kh.snapshot = nil
+}
+
+// replace atomically replaces the contents of the known_hosts file, keeping
+// its permissions
+func (kh *knownHosts) replace(lines []string) error {
+	info, err := os.Stat(kh.Path)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(kh.Path), ".known_hosts")
+	if err != nil {
+		return errors.Wrapf(err, "Could not create a temporary file to replace %q", kh.Path)
+	}
+	defer os.Remove(f.Name())
+
+	for _, line := range lines {
+		if _, err = fmt.Fprintf(f, "%s\n", line); err != nil {
+			f.Close()
+			return errors.Wrapf(err, "Could not write to %q", f.Name())
+		}
+	}
+
+	// It mustn't be renamed into place before its contents are durable, or a
+	// crash could leave known_hosts empty
+	if kh.Fsync {
+		if err = f.Sync(); err != nil {
+			f.Close()
+			return errors.Wrapf(err, "Could not sync %q", f.Name())
+		}
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Chmod(f.Name(), info.Mode()); err != nil {
+		return err
+	}
+
+	if err = os.Rename(f.Name(), kh.Path); err != nil {
+		return err
+	}
+
+	if kh.snapshot != nil {
+		kh.snapshot = &knownHostsSnapshot{lines: append([]string{}, lines...)}
+	}
+
+	if kh.Fsync {
+		return syncDir(filepath.Dir(kh.Path))
+	}
+
+	return nil
+}
+
+// hostMatches returns whether a known_hosts hostname, which may be hashed,
+// matches a normalized host. IPv6 literals written in brackets without a port,
+// as knownhosts.Line does, match too.
+func hostMatches(addr string, normalized string) bool {
+	if addr == normalized || hashedHostMatches(addr, normalized) {
+		return true
+	}
+
+	if strings.Contains(normalized, ":") && !strings.HasPrefix(normalized, "[") {
+		bracketed := "[" + normalized + "]"
+		return addr == bracketed || hashedHostMatches(addr, bracketed)
+	}
+
+	return false
+}
+
+// knownHostsPatternsMatch returns whether a normalized host matches a
+// known_hosts pattern list, e.g. "*.example.com,!untrusted.example.com", the
+// way OpenSSH matches them. Patterns can be hashed, or use * and ? wildcards,
+// and a host matching a negated pattern never matches. Hosts with a port are
+// matched in their bracketed form, e.g. [git.example.com]:2222, and IPv6
+// literals written in brackets without a port, as knownhosts.Line does, match
+// too.
+func knownHostsPatternsMatch(patterns string, normalized string) bool {
+	candidates := []string{strings.ToLower(normalized)}
+	if strings.Contains(normalized, ":") && !strings.HasPrefix(normalized, "[") {
+		candidates = append(candidates, "["+candidates[0]+"]")
+	}
+
+	matched := false
+
+	for _, pattern := range strings.Split(patterns, ",") {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		matches := false
+		for _, candidate := range candidates {
+			if hashedHostMatches(pattern, candidate) || wildcardMatch(strings.ToLower(pattern), candidate) {
+				matches = true
+				break
+			}
+		}
+		if !matches {
+			continue
+		}
+		if negated {
+			return false
+		}
+		matched = true
+	}
+
+	return matched
+}
+
+// knownHostsCIDRMatch returns whether a normalized host is an IP address in
+// one of the CIDR blocks of a known_hosts pattern list, e.g. "10.0.0.0/24" or
+// "[10.0.0.0/24]:2222" for a port, and doesn't match any of its negated
+// patterns
+func knownHostsCIDRMatch(patterns string, normalized string) bool {
+	hostname, port := splitHostPort(normalized)
+	ip := net.ParseIP(hostname)
+	if ip == nil {
+		return false
+	}
+
+	matched := false
+
+	for _, pattern := range strings.Split(patterns, ",") {
+		if strings.HasPrefix(pattern, "!") {
+			if knownHostsPatternsMatch(pattern[1:], normalized) || knownHostsCIDRMatch(pattern[1:], normalized) {
+				return false
+			}
+			continue
+		}
+
+		block, blockPort := splitHostPort(pattern)
+		if blockPort == "22" {
+			blockPort = ""
+		}
+		if !strings.Contains(block, "/") || blockPort != port {
+			continue
+		}
+		if _, network, err := net.ParseCIDR(block); err == nil && network.Contains(ip) {
+			matched = true
+		}
+	}
+
+	return matched
+}
+
+// wildcardMatch returns whether s matches a pattern where * matches any run of
+// characters and ? matches any one, like ssh_config patterns. Unlike
+// path.Match, [ and ] aren't special, as they bracket hosts with ports.
+func wildcardMatch(pattern string, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if wildcardMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+
+	return len(s) == 0
+}
+
+// hashedHostMatches returns whether a hashed known_hosts hostname, in the
+// form |1|salt|hash, is the hash of host
+func hashedHostMatches(hashed string, host string) bool {
+	parts := strings.Split(hashed, "|")
+	if len(parts) != 4 || parts[0] != "" || parts[1] != "1" {
+		return false
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+
+	hash, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(host))
+
+	return hmac.Equal(mac.Sum(nil), hash)
+}
+
+// annotateKnownHostsLines adds knownHostsManagedComment and the time to the end
+// of each known_hosts entry
+func annotateKnownHostsLines(lines string, at time.Time) string {
+	var annotated []string
+
+	for _, line := range strings.Split(lines, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			annotated = append(annotated, line)
+			continue
+		}
+		annotated = append(annotated, fmt.Sprintf("%s %s%s", line, knownHostsManagedComment, at.UTC().Format(time.RFC3339)))
+	}
+
+	return strings.Join(annotated, "\n")
+}
+
+// isManagedKnownHostsLine returns whether a known_hosts entry was written by
+// the agent
+func isManagedKnownHostsLine(line string) bool {
+	_, _, _, comment, _, err := ssh.ParseKnownHosts([]byte(line))
+	return err == nil && strings.HasPrefix(comment, knownHostsManagedComment)
+}
+
+// hashKnownHostsLines replaces the plaintext hostnames in known_hosts lines
+// with hashed ones. Like `ssh-keygen -H`, a line with several hostnames is
+// split into one line per hostname.
+func hashKnownHostsLines(lines string) string {
+	var hashed []string
+
+	for _, line := range strings.Split(lines, "\n") {
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "|") {
+			hashed = append(hashed, line)
+			continue
+		}
+		for _, addr := range strings.Split(fields[0], ",") {
+			hashed = append(hashed, knownhosts.HashHostname(addr)+" "+fields[1])
+		}
+	}
+
+	return strings.Join(hashed, "\n")
+}
+
+// splitHostPort splits a host that may include a port into the hostname and
+// port, handling both bare and bracketed IPv6 literals. The port is empty if
+// the host doesn't include one.
+func splitHostPort(host string) (string, string) {
+	if hostname, port, err := net.SplitHostPort(host); err == nil {
+		return hostname, port
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), ""
+}
+
+// normalizeHost returns a host in the form OpenSSH records it in known_hosts,
+// e.g. "example.com", "[example.com]:2222", "2001:db8::1" or "[2001:db8::1]:2222"
+func normalizeHost(host string) string {
+	hostname, port := splitHostPort(host)
+	if port == "" || port == "22" {
+		return hostname
+	}
+	return "[" + hostname + "]:" + port
+}
+
+// AddFromRepository takes a git repo url, extracts the host and adds it
+func (kh *knownHosts) AddFromRepository(repository string) error {
+	host, err := kh.hostFromRepository(repository)
+	if err != nil || host == "" {
+		return err
+	}
+
+	if _, err = kh.Add(host); err != nil {
+		return errors.Wrapf(err, "Failed to add `%s` to known_hosts file `%s`", host, repository)
+	}
+
+	return nil
+}
+
+// AddFromRepositories takes several git repo urls, extracts the hosts and adds
+// them, acquiring the known_hosts lock only once. Like AddMany, a repository
+// that can't be parsed or a host that fails to be added doesn't stop the rest.
+// The error combines both, and the results are what AddMany did.
+func (kh *knownHosts) AddFromRepositories(repositories []string) (knownHostsResults, error) {
+	var hosts []string
+	var errs []error
+
+	for _, repository := range repositories {
+		host, err := kh.hostFromRepository(repository)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+
+	if len(hosts) == 0 {
+		return nil, combineKnownHostsErrors(errs)
+	}
+
+	results := kh.AddMany(hosts)
+	err := results.Err()
+	if isHostKeyError(err) {
+		return results, err
+	}
+	if multi, ok := err.(knownHostsErrors); ok {
+		errs = append(errs, multi...)
+	} else if err != nil {
+		errs = append(errs, err)
+	}
+
+	return results, combineKnownHostsErrors(errs)
+}
+
+// hostFromRepository returns the ssh host for a git repo url, or an empty
+// string if the repository isn't accessed over ssh. URLRewrites are applied
+// first, the same as git applies them. It's resolved through the user's ssh
+// config when it's added.
+func (kh *knownHosts) hostFromRepository(repository string) (string, error) {
+	if rewritten, rewrite, ok := rewriteGitURL(repository, kh.URLRewrites); ok {
+		kh.Shell.Commentf("Repository %q is fetched from %q, as git rewrites %q to %q", repository, rewritten, rewrite.InsteadOf, rewrite.Base)
+		repository = rewritten
+	}
+
+	host, err := repositorySSHHost(repository)
+	if err != nil {
+		kh.Shell.Warningf("Could not parse %q as a URL - skipping adding host to SSH known_hosts", repository)
+		return "", err
+	}
+
+	return host, nil
+}
+
+// repositorySSHHost returns the host (and port, if there is one) of a git repo
+// url that's accessed over ssh, e.g. git@host:path or ssh://user@host:port/path.
+// An empty string is returned for other repositories, e.g. https://host/path.
+func repositorySSHHost(repository string) (string, error) {
+	u, err := parseGittableURL(repository)
+	if err != nil {
+		return "", err
+	}
+
+	// We only need to keyscan ssh repository urls. IPv6 literals are only
+	// bracketed when there's a port, the same as in known_hosts.
+	switch u.Scheme {
+	case "ssh", "git+ssh", "ssh+git":
+		if u.Port() == "" {
+			return u.Hostname(), nil
+		}
+		return u.Host, nil
+	}
+
+	return "", nil
 }
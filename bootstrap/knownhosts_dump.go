@@ -0,0 +1,141 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"golang.org/x/crypto/ssh"
+)
+
+// KnownHostsEntry is a host key trusted by known_hosts
+type KnownHostsEntry struct {
+	// The hosts the key is trusted for. Hashed hostnames are replaced with the
+	// probed host they're the hash of, if there is one.
+	Hosts []string
+
+	// How many of the entry's hostnames are hashed and didn't match any of
+	// the probed hosts, so can't be shown
+	Hashed int
+
+	// "cert-authority" or "revoked" if the entry is marked as one
+	Marker string
+
+	KeyType     string
+	Fingerprint string
+
+	// The entry's line in the file, starting from 1
+	Line int
+}
+
+// String returns the entry the way it's printed, e.g.
+// "github.com ssh-ed25519 SHA256:..."
+func (e KnownHostsEntry) String() string {
+	hosts := append([]string{}, e.Hosts...)
+	if e.Hashed > 0 {
+		hosts = append(hosts, fmt.Sprintf("(%d hashed)", e.Hashed))
+	}
+
+	s := strings.Join(hosts, ",") + " " + e.KeyType + " " + e.Fingerprint
+	if e.Marker != "" {
+		s = "@" + e.Marker + " " + s
+	}
+	return s
+}
+
+// KnownHostsDump is what's trusted by a known_hosts file
+type KnownHostsDump struct {
+	Path    string
+	Entries []KnownHostsEntry
+
+	// The lines of entries that couldn't be parsed, starting from 1
+	Malformed []int
+}
+
+// DumpKnownHosts reads the known_hosts file the agent would use with the given
+// config and returns the host keys it trusts, so they can be shown the same way
+// whatever format the file is in. Hashed hostnames are shown as the host they
+// hash, if it's one of the probed hosts or the hosts with pinned fingerprints.
+// The file is never created or changed, and its lock isn't taken.
+func DumpKnownHosts(ctx context.Context, conf Config, probes []string) (KnownHostsDump, error) {
+	sh, err := shell.NewWithContext(ctx)
+	if err != nil {
+		return KnownHostsDump{}, err
+	}
+	sh.Debug = conf.Debug
+
+	return dumpKnownHosts(sh, conf, probes)
+}
+
+func dumpKnownHosts(sh *shell.Shell, conf Config, probes []string) (KnownHostsDump, error) {
+	b := New(conf)
+	b.shell = sh
+
+	path, _, err := b.sharedKnownHostsPath()
+	if err != nil {
+		return KnownHostsDump{}, err
+	}
+
+	fingerprints, err := parseHostKeyFingerprints(conf.SSHKnownHostsFingerprints)
+	if err != nil {
+		return KnownHostsDump{}, err
+	}
+	for host := range fingerprints {
+		probes = append(probes, host)
+	}
+
+	kh := &knownHosts{Shell: sh, Path: path}
+	lines, err := kh.readLines()
+	if os.IsNotExist(err) {
+		return KnownHostsDump{}, fmt.Errorf("Known_hosts file %q doesn't exist", path)
+	} else if err != nil {
+		return KnownHostsDump{}, fmt.Errorf("Could not read known_hosts file %q: %v", path, err)
+	}
+
+	dump := KnownHostsDump{Path: path}
+
+	for i, line := range lines {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		marker, hosts, key, _, _, err := ssh.ParseKnownHosts([]byte(line))
+		if err != nil {
+			dump.Malformed = append(dump.Malformed, i+1)
+			continue
+		}
+
+		entry := KnownHostsEntry{
+			Marker:      marker,
+			KeyType:     key.Type(),
+			Fingerprint: ssh.FingerprintSHA256(key),
+			Line:        i + 1,
+		}
+		for _, host := range hosts {
+			if !strings.HasPrefix(host, "|") {
+				entry.Hosts = append(entry.Hosts, host)
+			} else if probe, ok := unhashKnownHost(host, probes); ok {
+				entry.Hosts = append(entry.Hosts, probe)
+			} else {
+				entry.Hashed++
+			}
+		}
+
+		dump.Entries = append(dump.Entries, entry)
+	}
+
+	return dump, nil
+}
+
+// unhashKnownHost returns the probed host a hashed known_hosts hostname is the
+// hash of, in the form it's recorded in, if there is one
+func unhashKnownHost(hashed string, probes []string) (string, bool) {
+	for _, probe := range probes {
+		if normalized := normalizeHost(probe); hashedHostMatches(hashed, normalized) {
+			return normalized, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,85 @@
+package bootstrap
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestDumpingKnownHosts(t *testing.T) {
+	t.Parallel()
+
+	_, hostKey := startTestSSHServer(t)
+	key := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(hostKey)))
+	fingerprint := ssh.FingerprintSHA256(hostKey)
+
+	dir, err := ioutil.TempDir("", "known-hosts-dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "known_hosts")
+	contents := strings.Join([]string{
+		"# A comment",
+		"github.com,192.0.2.10 " + key,
+		knownhosts.HashHostname("[git.example.com]:2222") + " " + key,
+		knownhosts.HashHostname("secret.example.com") + " " + key,
+		"@cert-authority *.example.com " + key,
+		"not an entry",
+	}, "\n") + "\n"
+	if err = ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sh := shell.NewTestShell(t)
+	dump, err := dumpKnownHosts(sh, Config{SSHKnownHostsPath: path}, []string{"git.example.com:2222"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, path, dump.Path)
+	assert.Equal(t, []int{6}, dump.Malformed)
+
+	var lines []string
+	for _, entry := range dump.Entries {
+		lines = append(lines, entry.String())
+	}
+	assert.Equal(t, []string{
+		"github.com,192.0.2.10 ssh-ed25519 " + fingerprint,
+		"[git.example.com]:2222 ssh-ed25519 " + fingerprint,
+		"(1 hashed) ssh-ed25519 " + fingerprint,
+		"@cert-authority *.example.com ssh-ed25519 " + fingerprint,
+	}, lines)
+
+	// It's only ever read
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, info.ModTime(), after.ModTime())
+	if _, err = os.Stat(path + ".lock"); !os.IsNotExist(err) {
+		t.Errorf("Expected no lock file, got %v", err)
+	}
+
+	// A missing file isn't created
+	missing := filepath.Join(dir, "ssh", "known_hosts")
+	_, err = dumpKnownHosts(sh, Config{SSHKnownHostsPath: missing}, nil)
+	assert.EqualError(t, err, fmt.Sprintf("Known_hosts file %q doesn't exist", missing))
+	if _, err = os.Stat(filepath.Dir(missing)); !os.IsNotExist(err) {
+		t.Errorf("Expected the ssh directory not to be created, got %v", err)
+	}
+}
@@ -0,0 +1,7 @@
+// +build !windows
+
+package bootstrap
+
+// Other platforms don't have mandatory file locking, so opening known_hosts
+// doesn't fail because another process has it open
+var knownHostsTransientOpenErrors []error
@@ -0,0 +1,12 @@
+// +build windows
+
+package bootstrap
+
+import "golang.org/x/sys/windows"
+
+// Antivirus can briefly have known_hosts open without sharing it, even while
+// we hold its lock, so opening it fails with one of these until it's done
+var knownHostsTransientOpenErrors = []error{
+	windows.ERROR_SHARING_VIOLATION,
+	windows.ERROR_LOCK_VIOLATION,
+}
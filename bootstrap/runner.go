@@ -0,0 +1,17 @@
+package bootstrap
+
+import "github.com/buildkite/agent/v3/bootstrap/shell"
+
+// Runner runs an external command and captures its output. It's how the
+// commands used to manage known_hosts, like ssh-keyscan and ssh, are run, so
+// they can be faked in tests. *shell.Shell implements it.
+type Runner interface {
+	// RunAndCapture runs a command and returns its stdout
+	RunAndCapture(command string, arg ...string) (string, error)
+
+	// RunAndCaptureStreams runs a command and returns its stdout and stderr
+	// separately
+	RunAndCaptureStreams(command string, arg ...string) (string, string, error)
+}
+
+var _ Runner = (*shell.Shell)(nil)
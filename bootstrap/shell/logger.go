@@ -8,7 +8,12 @@ import (
 	"os"
 	"regexp"
 	"runtime"
+	"strings"
 	"testing"
+
+	"github.com/buildkite/agent/v3/env"
+	"github.com/buildkite/agent/v3/logger"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
 // Logger represents a logger that outputs to a buildkite shell.
@@ -48,7 +53,44 @@ var DiscardLogger = &WriterLogger{
 // WriterLogger provides a logger that writes to an io.Writer
 type WriterLogger struct {
 	Writer io.Writer
-	Ansi   bool
+
+	// Whether output is styled with ANSI colors, otherwise it's plain text
+	Ansi bool
+}
+
+// The color modes that decide whether a WriterLogger's output is styled
+const (
+	// Output is styled when it's written to a terminal, unless NO_COLOR is set
+	ColorAuto = "auto"
+
+	// Output is always styled
+	ColorAlways = "always"
+
+	// Output is always plain text
+	ColorNever = "never"
+)
+
+// AnsiEnabled returns whether output written to w should be styled with ANSI
+// colors in a color mode, which defaults to auto. In auto mode, output is
+// styled when w is a terminal and NO_COLOR isn't set to a value in environ.
+func AnsiEnabled(mode string, w io.Writer, environ *env.Environment) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(mode)) {
+	case ColorAlways:
+		return true, nil
+	case ColorNever:
+		return false, nil
+	case "", ColorAuto:
+	default:
+		return false, fmt.Errorf("Unknown color mode %q, expected one of auto, always or never", mode)
+	}
+
+	// See https://no-color.org
+	if noColor, ok := environ.Get("NO_COLOR"); ok && noColor != "" {
+		return false, nil
+	}
+
+	f, ok := w.(*os.File)
+	return ok && terminal.IsTerminal(int(f.Fd())), nil
 }
 
 func (wl *WriterLogger) Write(b []byte) (int, error) {
@@ -104,6 +146,47 @@ func (wl *WriterLogger) Promptf(format string, v ...interface{}) {
 	}
 }
 
+// LevelLogger is a Logger that writes to a leveled logger.Logger, so output can
+// be filtered by level and annotated with fields, e.g. for log aggregation.
+// Comments are logged at debug level, headers at notice, and prompts and other
+// output at info.
+type LevelLogger struct {
+	Logger logger.Logger
+}
+
+func (ll *LevelLogger) Write(b []byte) (int, error) {
+	ll.Printf("%s", bytes.TrimRight(b, "\n"))
+	return len(b), nil
+}
+
+func (ll *LevelLogger) Printf(format string, v ...interface{}) {
+	ll.Logger.Info("%s", fmt.Sprintf(format, v...))
+}
+
+func (ll *LevelLogger) Headerf(format string, v ...interface{}) {
+	ll.Logger.Notice("%s", fmt.Sprintf(format, v...))
+}
+
+func (ll *LevelLogger) Commentf(format string, v ...interface{}) {
+	ll.Logger.Debug("%s", fmt.Sprintf(format, v...))
+}
+
+func (ll *LevelLogger) Errorf(format string, v ...interface{}) {
+	ll.Logger.Error("%s", fmt.Sprintf(format, v...))
+}
+
+func (ll *LevelLogger) Warningf(format string, v ...interface{}) {
+	ll.Logger.Warn("%s", fmt.Sprintf(format, v...))
+}
+
+func (ll *LevelLogger) Promptf(format string, v ...interface{}) {
+	prompt := "$"
+	if runtime.GOOS == "windows" {
+		prompt = ">"
+	}
+	ll.Logger.Info(prompt+" %s", fmt.Sprintf(format, v...))
+}
+
 func ansiColor(s, attributes string) string {
 	return fmt.Sprintf("\033[%sm%s\033[0m", attributes, s)
 }
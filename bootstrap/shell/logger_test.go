@@ -4,9 +4,12 @@ import (
 	"bytes"
 	"fmt"
 	"runtime"
+	"strings"
 	"testing"
 
 	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/buildkite/agent/v3/env"
+	"github.com/buildkite/agent/v3/logger"
 )
 
 func TestAnsiLogger(t *testing.T) {
@@ -44,6 +47,36 @@ func TestAnsiLogger(t *testing.T) {
 	}
 }
 
+func TestAnsiEnabled(t *testing.T) {
+	noColor := env.FromSlice([]string{"NO_COLOR=1"})
+
+	for _, tc := range []struct {
+		mode    string
+		environ *env.Environment
+		ansi    bool
+	}{
+		{"", env.New(), false},
+		{shell.ColorAuto, env.New(), false},
+		{shell.ColorAuto, noColor, false},
+		{shell.ColorAlways, env.New(), true},
+		{"Always", noColor, true},
+		{shell.ColorNever, env.New(), false},
+	} {
+		ansi, err := shell.AnsiEnabled(tc.mode, &bytes.Buffer{}, tc.environ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ansi != tc.ansi {
+			t.Errorf("Expected AnsiEnabled(%q) to be %t, got %t", tc.mode, tc.ansi, ansi)
+		}
+	}
+
+	_, err := shell.AnsiEnabled("rainbow", &bytes.Buffer{}, env.New())
+	if err == nil || err.Error() != `Unknown color mode "rainbow", expected one of auto, always or never` {
+		t.Errorf("Expected an unknown color mode error, got %v", err)
+	}
+}
+
 func TestLoggerStreamer(t *testing.T) {
 	b := &bytes.Buffer{}
 	l := &shell.WriterLogger{Writer: b, Ansi: false}
@@ -73,3 +106,40 @@ func TestLoggerStreamer(t *testing.T) {
 		t.Fatalf("Expected %q, got %q", expected.String(), actual)
 	}
 }
+
+func TestLevelLogger(t *testing.T) {
+	b := &bytes.Buffer{}
+
+	printer := logger.NewTextPrinter(b)
+	printer.Colors = false
+
+	l := logger.NewConsoleLogger(printer, func(int) {})
+	l.SetLevel(logger.NOTICE)
+
+	ll := shell.LevelLogger{Logger: l}
+
+	ll.Headerf("Testing header: %q", "llamas")
+	ll.Printf("Testing print: %q", "llamas")
+	ll.Commentf("Testing comment: %q", "llamas")
+	ll.Errorf("Testing error: %q", "llamas")
+	ll.Warningf("Testing warning: %q", "llamas")
+
+	lines := strings.Split(strings.TrimRight(b.String(), "\n"), "\n")
+
+	expected := []string{
+		`Testing header: "llamas"`,
+		`Testing print: "llamas"`,
+		`Testing error: "llamas"`,
+		`Testing warning: "llamas"`,
+	}
+
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %d lines, got %q", len(expected), lines)
+	}
+
+	for idx, line := range lines {
+		if !strings.HasSuffix(line, expected[idx]) {
+			t.Errorf("Expected line %d to end with %q, got %q", idx, expected[idx], line)
+		}
+	}
+}
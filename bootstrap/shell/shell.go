@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"math/rand"
 	"os"
 	"os/exec"
 	"path"
@@ -27,9 +28,31 @@ import (
 )
 
 var (
-	lockRetryDuration = time.Second
+	// How long to wait before trying a lock again, which doubles after each
+	// attempt up to lockRetryMaxDuration. Each wait is jittered by up to half
+	// either way, so processes started together don't all poll in step.
+	lockRetryDuration    = 250 * time.Millisecond
+	lockRetryMaxDuration = 4 * time.Second
+
+	// ErrTimeout is returned when a command is killed for running longer than
+	// the timeout given to WithTimeout
+	ErrTimeout = errors.New("Command timed out")
+
+	lockRetryRandom = struct {
+		sync.Mutex
+		*rand.Rand
+	}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
 )
 
+// lockRetryDelay returns how long to wait before the next attempt at a lock,
+// given the current un-jittered delay
+func lockRetryDelay(delay time.Duration) time.Duration {
+	lockRetryRandom.Lock()
+	defer lockRetryRandom.Unlock()
+
+	return delay/2 + time.Duration(lockRetryRandom.Int63n(int64(delay)))
+}
+
 // Shell represents a virtual shell, handles logging, executing commands and
 // provides hooks for capturing output and exit conditions.
 //
@@ -55,6 +78,17 @@ type Shell struct {
 	// Whether to run the shell in debug mode
 	Debug bool
 
+	// Whether to log every command that's run, including quiet ones, with its
+	// working directory, how it exited and how long it took. Commands are
+	// logged through Logger, so they're redacted if it is.
+	Trace bool
+
+	// Whether commands are run without being echoed, see WithQuiet()
+	quiet bool
+
+	// How long commands can run before they're killed, see WithTimeout()
+	timeout time.Duration
+
 	// Current working directory that shell commands get executed in
 	wd string
 
@@ -69,46 +103,192 @@ type Shell struct {
 	InterruptSignal process.Signal
 }
 
-// New returns a new Shell
-func New() (*Shell, error) {
+// Option configures a Shell created with New or NewWithContext
+type Option func(*Shell) error
+
+// WithWriter sets where the output of commands is written, instead of
+// os.Stdout
+func WithWriter(w io.Writer) Option {
+	return func(s *Shell) error {
+		s.Writer = w
+		return nil
+	}
+}
+
+// WithLogger sets where the shell logs prompts, comments and errors, instead
+// of StderrLogger
+func WithLogger(l Logger) Option {
+	return func(s *Shell) error {
+		s.Logger = l
+		return nil
+	}
+}
+
+// WithWorkingDir sets the directory commands are run in, instead of the
+// current working directory of the process. The directory must exist.
+func WithWorkingDir(path string) Option {
+	return func(s *Shell) error {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(s.wd, path)
+		}
+
+		if info, err := os.Stat(path); err != nil {
+			return fmt.Errorf("Failed to use working directory %q: directory does not exist", path)
+		} else if !info.IsDir() {
+			return fmt.Errorf("Failed to use working directory %q: not a directory", path)
+		}
+
+		s.wd = path
+		return nil
+	}
+}
+
+// WithEnvironment sets the environment commands are run with, instead of the
+// environment of the process
+func WithEnvironment(e *env.Environment) Option {
+	return func(s *Shell) error {
+		s.Env = e
+		return nil
+	}
+}
+
+// New returns a new Shell, configured by the given options
+func New(opts ...Option) (*Shell, error) {
+	return NewWithContext(context.Background(), opts...)
+}
+
+// NewWithContext returns a new Shell with provided context.Context, configured
+// by the given options
+func NewWithContext(ctx context.Context, opts ...Option) (*Shell, error) {
 	wd, err := os.Getwd()
 	if err != nil {
 		return nil, errors.Wrapf(err, "Failed to find current working directory")
 	}
 
-	return &Shell{
+	sh := &Shell{
 		Logger: StderrLogger,
 		Env:    env.FromSlice(os.Environ()),
 		Writer: os.Stdout,
 		wd:     wd,
-		ctx:    context.Background(),
-	}, nil
-}
+		ctx:    ctx,
+	}
 
-// New returns a new Shell with provided context.Context
-func NewWithContext(ctx context.Context) (*Shell, error) {
-	sh, err := New()
-	if err != nil {
-		return nil, err
+	for _, opt := range opts {
+		if err := opt(sh); err != nil {
+			return nil, err
+		}
 	}
 
-	sh.ctx = ctx
 	return sh, nil
 }
 
+// Context returns the context.Context commands run by the Shell are bound to
+func (s *Shell) Context() context.Context {
+	return s.ctx
+}
+
 // WithStdin returns a copy of the Shell with the provided io.Reader set as the
 // Stdin for the next command. The copy should be discarded after one command.
+// A PTY is never used with stdin, so the command sees EOF once the reader is
+// exhausted.
 // e.g. sh.WithStdin(strings.NewReader("hello world")).Run("cat")
 func (s *Shell) WithStdin(r io.Reader) *Shell {
-	// cargo-culted cmdLock, not sure if it's needed
+	sh := s.clone()
+	sh.stdin = r // our new stdin
+	sh.PTY = false
+	return sh
+}
+
+// WithStdinString is like WithStdin, but takes the input as a string
+// e.g. sh.WithStdinString("github.com\n").RunAndCapture("ssh-keyscan", "-f", "-")
+func (s *Shell) WithStdinString(input string) *Shell {
+	return s.WithStdin(strings.NewReader(input))
+}
+
+// WithWriters returns a copy of the Shell that writes the output of the next
+// command to the provided writers as well as its own Writer, e.g. to keep a
+// copy of it in a file. A writer failing doesn't stop output being written to
+// the others. The copy should be discarded after one command.
+func (s *Shell) WithWriters(writers ...io.Writer) *Shell {
+	sh := s.clone()
+	sh.Writer = NewMultiWriter(append([]io.Writer{s.Writer}, writers...)...)
+	return sh
+}
+
+// WithEnv returns a copy of the Shell with the provided environment merged over
+// its own for the next command, without modifying the Shell's environment. The
+// copy should be discarded after one command.
+// e.g. sh.WithEnv(env.FromSlice([]string{"HOME=/tmp"})).Run("ssh-keyscan", "github.com")
+func (s *Shell) WithEnv(e *env.Environment) *Shell {
+	sh := s.clone()
+	sh.Env = s.Env.Merge(e)
+	return sh
+}
+
+// WithCleanEnv returns a copy of the Shell with only the provided environment
+// for the next command, none of the Shell's environment is inherited. Note
+// that PATH needs to be in the environment to run commands by name. The copy
+// should be discarded after one command.
+func (s *Shell) WithCleanEnv(e *env.Environment) *Shell {
+	sh := s.clone()
+	sh.Env = env.New().Merge(e)
+	return sh
+}
+
+// WithDir returns a copy of the Shell that runs the next command in the given
+// directory, relative to the Shell's working directory, without changing the
+// Shell's own working directory. An error is returned if the directory doesn't
+// exist. The copy should be discarded after one command.
+func (s *Shell) WithDir(path string) (*Shell, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(s.wd, path)
+	}
+
+	if info, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("Failed to run in %q: directory does not exist", path)
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("Failed to run in %q: not a directory", path)
+	}
+
+	sh := s.clone()
+	sh.wd = path
+	return sh, nil
+}
+
+// WithQuiet returns a copy of the Shell that doesn't echo the next command it
+// runs, even in debug mode. Output and errors are still captured, which is
+// useful for internal commands users didn't ask for. The copy should be
+// discarded after one command.
+func (s *Shell) WithQuiet() *Shell {
+	sh := s.clone()
+	sh.quiet = true
+	return sh
+}
+
+// WithTimeout returns a copy of the Shell that kills the next command it runs,
+// along with any processes it started, if it's still running after the given
+// duration. The command returns an error wrapping ErrTimeout, and any output it
+// captured is discarded. The copy should be discarded after one command.
+func (s *Shell) WithTimeout(timeout time.Duration) *Shell {
+	sh := s.clone()
+	sh.timeout = timeout
+	return sh
+}
+
+// clone returns a copy of the Shell for running a single command
+func (s *Shell) clone() *Shell {
 	s.cmdLock.Lock()
 	defer s.cmdLock.Unlock()
-	// Can't copy struct like `newsh := *s` because sync.Mutex can't be copied.
 	return &Shell{
 		Logger:          s.Logger,
 		Env:             s.Env,
-		stdin:           r, // our new stdin
+		PTY:             s.PTY,
+		stdin:           s.stdin,
 		Writer:          s.Writer,
+		Debug:           s.Debug,
+		Trace:           s.Trace,
+		quiet:           s.quiet,
+		timeout:         s.timeout,
 		wd:              s.wd,
 		ctx:             s.ctx,
 		InterruptSignal: s.InterruptSignal,
@@ -145,17 +325,35 @@ func (s *Shell) AbsolutePath(executable string) (string, error) {
 		return executable, nil
 	}
 
+	return s.LookPath(executable)
+}
+
+// LookPath searches for an executable in the PATH of the Shell (and with the
+// PATHEXT of the Shell on Windows) rather than that of the agent process, and
+// returns its absolute path. Relative paths, both in PATH and the executable
+// itself, are relative to the Shell's working directory.
+func (s *Shell) LookPath(executable string) (string, error) {
 	envPath, _ := s.Env.Get("PATH")
 	fileExtensions, _ := s.Env.Get("PATHEXT") // For searching .exe, .bat, etc on Windows
 
+	var dirs []string
+	for _, dir := range filepath.SplitList(envPath) {
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(s.wd, dir)
+		}
+		dirs = append(dirs, dir)
+	}
+
+	if filepath.Base(executable) != executable && !filepath.IsAbs(executable) {
+		executable = filepath.Join(s.wd, executable)
+	}
+
 	// Use our custom lookPath that takes a specific path
-	absolutePath, err := LookPath(executable, envPath, fileExtensions)
+	absolutePath, err := LookPath(executable, strings.Join(dirs, string(os.PathListSeparator)), fileExtensions)
 	if err != nil {
 		return "", err
 	}
 
-	// Since the path returned by LookPath is relative to the current working
-	// directory, we need to get the absolute version of that.
 	return filepath.Abs(absolutePath)
 }
 
@@ -186,6 +384,14 @@ type LockFile interface {
 
 // Create a cross-process file-based lock based on pid files
 func (s *Shell) LockFile(path string, timeout time.Duration) (LockFile, error) {
+	return s.LockFileWithContext(s.ctx, path, timeout)
+}
+
+// LockFileWithContext is like LockFile, but stops waiting for the lock when
+// the given context is done. context.DeadlineExceeded is returned if the lock
+// couldn't be acquired within the timeout, and context.Canceled if the context
+// was cancelled first.
+func (s *Shell) LockFileWithContext(ctx context.Context, path string, timeout time.Duration) (LockFile, error) {
 	absolutePathToLock, err := filepath.Abs(path)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to find absolute path to lock \"%s\" (%v)", path, err)
@@ -196,15 +402,20 @@ func (s *Shell) LockFile(path string, timeout time.Duration) (LockFile, error) {
 		return nil, fmt.Errorf("Failed to create lock \"%s\" (%s)", absolutePathToLock, err)
 	}
 
-	ctx, cancel := context.WithTimeout(s.ctx, timeout)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
+	delay := lockRetryDuration
+
 	for {
 		// Keep trying the lock until we get it
-		if err := lock.TryLock(); err != nil {
+		wait := lockRetryDelay(delay)
+		if err := lock.TryLock(); errors.Is(err, syscall.EROFS) {
+			// The lock can never be created, so there's no point waiting
+			return nil, err
+		} else if err != nil {
 			s.Commentf("Could not acquire lock on \"%s\" (%s)", absolutePathToLock, err)
-			s.Commentf("Trying again in %s...", lockRetryDuration)
-			time.Sleep(lockRetryDuration)
+			s.Commentf("Trying again in %s...", wait.Round(time.Millisecond))
 		} else {
 			break
 		}
@@ -212,8 +423,12 @@ func (s *Shell) LockFile(path string, timeout time.Duration) (LockFile, error) {
 		select {
 		case <-ctx.Done():
 			return nil, ctx.Err()
-		default:
-			// No value ready, moving on
+		case <-time.After(wait):
+			// Try again
+		}
+
+		if delay *= 2; delay > lockRetryMaxDuration {
+			delay = lockRetryMaxDuration
 		}
 	}
 
@@ -223,12 +438,14 @@ func (s *Shell) LockFile(path string, timeout time.Duration) (LockFile, error) {
 // Run runs a command, write stdout and stderr to the logger and return an error
 // if it fails
 func (s *Shell) Run(command string, arg ...string) error {
-	formatted := process.FormatCommand(command, arg)
-	if s.stdin == nil {
-		s.Promptf("%s", formatted)
-	} else {
-		// bash-syntax-compatible indication that input is coming from somewhere
-		s.Promptf("%s < /dev/stdin", formatted)
+	if !s.quiet {
+		formatted := process.FormatCommand(command, arg)
+		if s.stdin == nil {
+			s.Promptf("%s", formatted)
+		} else {
+			// bash-syntax-compatible indication that input is coming from somewhere
+			s.Promptf("%s < /dev/stdin", formatted)
+		}
 	}
 
 	return s.RunWithoutPrompt(command, arg...)
@@ -258,22 +475,64 @@ func (s *Shell) RunWithoutPromptWithContext(ctx context.Context, command string,
 	})
 }
 
+// RunAndTee runs a command like Run, streaming stdout and stderr to the Writer
+// as they're produced, and also returns everything that was written. Stdout and
+// stderr share a single stream so their ordering is preserved.
+func (s *Shell) RunAndTee(command string, arg ...string) (string, error) {
+	if !s.quiet {
+		formatted := process.FormatCommand(command, arg)
+		if s.stdin == nil {
+			s.Promptf("%s", formatted)
+		} else {
+			// bash-syntax-compatible indication that input is coming from somewhere
+			s.Promptf("%s < /dev/stdin", formatted)
+		}
+	}
+
+	cmd, err := s.buildCommand(s.ctx, command, arg...)
+	if err != nil {
+		s.Errorf("Error building command: %v", err)
+		return "", err
+	}
+
+	var b bytes.Buffer
+
+	err = s.executeCommand(s.ctx, cmd, io.MultiWriter(s.Writer, &b), executeFlags{
+		Stdout: true,
+		Stderr: true,
+		PTY:    s.PTY,
+	})
+	if errors.Is(err, ErrTimeout) {
+		return "", err
+	}
+
+	return b.String(), err
+}
+
 // RunAndCapture runs a command and captures the output for processing. Stdout is captured, but
 // stderr isn't. If the shell is in debug mode then the command will be eched and both stderr
 // and stdout will be written to the logger. A PTY is never used for RunAndCapture.
+// It will use the context set on the Shell object itself.
 func (s *Shell) RunAndCapture(command string, arg ...string) (string, error) {
-	if s.Debug {
+	return s.RunAndCaptureWithContext(s.ctx, command, arg...)
+}
+
+// RunAndCaptureWithContext is like RunAndCapture, but uses the given context.
+// The command and any processes it started are terminated if the context is
+// cancelled.
+func (s *Shell) RunAndCaptureWithContext(ctx context.Context, command string, arg ...string) (string, error) {
+	if s.Debug && !s.quiet {
 		s.Promptf("%s", process.FormatCommand(command, arg))
 	}
 
-	cmd, err := s.buildCommand(s.ctx, command, arg...)
+	cmd, err := s.buildCommand(ctx, command, arg...)
 	if err != nil {
 		return "", err
 	}
 
 	var b bytes.Buffer
 
-	err = s.executeCommand(s.ctx, cmd, &b, executeFlags{
+	err = s.executeCommand(ctx, cmd, &b, executeFlags{
 		Stdout: true,
 		Stderr: false,
 		PTY:    false,
@@ -285,6 +544,33 @@ func (s *Shell) RunAndCapture(command string, arg ...string) (string, error) {
 	return strings.TrimSpace(b.String()), nil
 }
 
+// RunAndCaptureStreams runs a command and captures stdout and stderr separately,
+// so diagnostics written to stderr can't be mistaken for output. Both are
+// trimmed of whitespace. A PTY is never used for RunAndCaptureStreams.
+func (s *Shell) RunAndCaptureStreams(command string, arg ...string) (string, string, error) {
+	if s.Debug && !s.quiet {
+		s.Promptf("%s", process.FormatCommand(command, arg))
+	}
+
+	cmd, err := s.buildCommand(s.ctx, command, arg...)
+	if err != nil {
+		return "", "", err
+	}
+
+	var stdout, stderr bytes.Buffer
+
+	err = s.executeCommand(s.ctx, cmd, &stdout, executeFlags{
+		Stdout:       true,
+		StderrWriter: &stderr,
+		PTY:          false,
+	})
+	if errors.Is(err, ErrTimeout) {
+		return "", "", err
+	}
+
+	return strings.TrimSpace(stdout.String()), strings.TrimSpace(stderr.String()), err
+}
+
 // injectTraceCtx adds tracing information to the given env vars to support
 // distributed tracing across jobs/builds.
 func (s *Shell) injectTraceCtx(ctx context.Context, env *env.Environment) {
@@ -389,11 +675,21 @@ func (s *Shell) buildCommand(ctx context.Context, name string, arg ...string) (*
 		Stdin:           s.stdin,
 		Dir:             s.wd,
 		InterruptSignal: s.InterruptSignal,
+
+		// Commands like ssh-keyscan and git mustn't outlive the bootstrap,
+		// holding locks or connections
+		KillOnParentExit: true,
 	}
 
 	// Create a sub-context so that shell.Cancel() can interrupt
-	// a running command
-	subctx, cancel := context.WithCancel(ctx)
+	// a running command, and so it's killed if it runs past the timeout
+	var subctx context.Context
+	var cancel context.CancelFunc
+	if s.timeout > 0 {
+		subctx, cancel = context.WithTimeout(ctx, s.timeout)
+	} else {
+		subctx, cancel = context.WithCancel(ctx)
+	}
 	cfg.Context = subctx
 
 	// Add env that commands expect a shell to set
@@ -411,11 +707,14 @@ type executeFlags struct {
 	// Whether to capture stderr
 	Stderr bool
 
+	// Capture stderr to this writer rather than the one stdout is written to
+	StderrWriter io.Writer
+
 	// Run the command in a PTY
 	PTY bool
 }
 
-func (s *Shell) executeCommand(ctx context.Context, cmd *command, w io.Writer, flags executeFlags) error {
+func (s *Shell) executeCommand(ctx context.Context, cmd *command, w io.Writer, flags executeFlags) (err error) {
 	// Combine the two slices of env, let the latter overwrite the former
 	tracedEnv := env.FromSlice(cmd.Env)
 	s.injectTraceCtx(ctx, tracedEnv)
@@ -427,7 +726,14 @@ func (s *Shell) executeCommand(ctx context.Context, cmd *command, w io.Writer, f
 
 	cmdStr := process.FormatCommand(cmd.Path, cmd.Args)
 
-	if s.Debug {
+	if s.Trace {
+		t := time.Now()
+		defer func() {
+			s.traceCommand(cmdStr, cmd.Dir, time.Since(t), err)
+		}()
+	}
+
+	if s.Debug && !s.quiet {
 		t := time.Now()
 		defer func() {
 			s.Commentf("↳ Command completed in %v", time.Now().Sub(t))
@@ -456,7 +762,9 @@ func (s *Shell) executeCommand(ctx context.Context, cmd *command, w io.Writer, f
 		}
 
 		// Show stderr if requested or via debug
-		if flags.Stderr {
+		if flags.StderrWriter != nil {
+			cfg.Stderr = flags.StderrWriter
+		} else if flags.Stderr {
 			cfg.Stderr = w
 		} else if s.Debug {
 			stdErrStreamer := NewLoggerStreamer(s.Logger)
@@ -471,13 +779,33 @@ func (s *Shell) executeCommand(ctx context.Context, cmd *command, w io.Writer, f
 	s.cmd.proc = p
 	s.cmdLock.Unlock()
 
-	if err := p.Run(); err != nil {
+	err = p.Run()
+
+	// The process tree has been killed if the timeout passed, rather than the
+	// context it was run with finishing
+	if cmd.Context.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		return fmt.Errorf("`%s` was killed after %v: %w", cmdStr, s.timeout, ErrTimeout)
+	}
+
+	if err != nil {
 		return errors.Wrapf(err, "Error running `%s`", cmdStr)
 	}
 
 	return p.WaitResult()
 }
 
+// traceCommand logs a command that's finished running, for Trace
+func (s *Shell) traceCommand(cmdStr string, dir string, d time.Duration, err error) {
+	switch {
+	case err == nil:
+		s.Commentf("Trace: `%s` in %q exited with status 0 after %v", cmdStr, dir, d)
+	case IsExitError(err):
+		s.Commentf("Trace: `%s` in %q exited with status %d after %v", cmdStr, dir, GetExitCode(err), d)
+	default:
+		s.Commentf("Trace: `%s` in %q failed after %v: %v", cmdStr, dir, d, err)
+	}
+}
+
 // GetExitCode extracts an exit code from an error where the platform supports it,
 // otherwise returns 0 for no error and 1 for an error
 func GetExitCode(err error) int {
@@ -533,3 +861,8 @@ type ExitError struct {
 func (ee *ExitError) Error() string {
 	return ee.Message
 }
+
+// ExitCode returns the exit code, matching the method on exec.ExitError
+func (ee *ExitError) ExitCode() int {
+	return ee.Code
+}
@@ -15,7 +15,9 @@ import (
 	"time"
 
 	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/buildkite/agent/v3/env"
 	"github.com/buildkite/bintest/v3"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -70,6 +72,194 @@ func TestRunAndCaptureWithExitCode(t *testing.T) {
 	}
 }
 
+func TestExitErrorExitCode(t *testing.T) {
+	var err error = errors.Wrap(&shell.ExitError{Code: 24, Message: "Llama drama"}, "Failed")
+
+	if exitErr, ok := errors.Cause(err).(interface{ ExitCode() int }); !ok || exitErr.ExitCode() != 24 {
+		t.Fatalf("Expected an error with exit code 24, got %#v", err)
+	}
+	assert.Equal(t, 24, shell.GetExitCode(err))
+}
+
+func TestRunAndCaptureStreams(t *testing.T) {
+	sshKeyscan, err := bintest.CompileProxy("ssh-keyscan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sshKeyscan.Close()
+
+	sh := newShellForTest(t)
+
+	go func() {
+		call := <-sshKeyscan.Ch
+		fmt.Fprintln(call.Stdout, "github.com ssh-ed25519 xxx=")
+		fmt.Fprintln(call.Stderr, "# github.com:22 SSH-2.0-babeld")
+		call.Exit(0)
+	}()
+
+	stdout, stderr, err := sh.RunAndCaptureStreams(sshKeyscan.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "github.com ssh-ed25519 xxx=", stdout)
+	assert.Equal(t, "# github.com:22 SSH-2.0-babeld", stderr)
+}
+
+func TestWithEnv(t *testing.T) {
+	sshKeyscan, err := bintest.CompileProxy("ssh-keyscan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sshKeyscan.Close()
+
+	sh := newShellForTest(t)
+	sh.Env.Set("LLAMA", "1")
+
+	go func() {
+		call := <-sshKeyscan.Ch
+		fmt.Fprintf(call.Stdout, "%s %s", call.GetEnv("LLAMA"), call.GetEnv("ALPACA"))
+		call.Exit(0)
+	}()
+
+	out, err := sh.WithEnv(env.FromSlice([]string{"ALPACA=2"})).RunAndCapture(sshKeyscan.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "1 2", out)
+
+	if _, exists := sh.Env.Get("ALPACA"); exists {
+		t.Fatalf("Expected the shell's environment not to be modified")
+	}
+}
+
+func TestWithCleanEnv(t *testing.T) {
+	sshKeyscan, err := bintest.CompileProxy("ssh-keyscan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sshKeyscan.Close()
+
+	sh := newShellForTest(t)
+	sh.Env.Set("LLAMA", "1")
+
+	go func() {
+		call := <-sshKeyscan.Ch
+		fmt.Fprintf(call.Stdout, "%q %s", call.GetEnv("LLAMA"), call.GetEnv("ALPACA"))
+		call.Exit(0)
+	}()
+
+	out, err := sh.WithCleanEnv(env.FromSlice([]string{"ALPACA=2"})).RunAndCapture(sshKeyscan.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, `"" 2`, out)
+}
+
+func TestNewWithOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shelltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// macos has a symlinked temp dir
+	if runtime.GOOS == "darwin" {
+		dir, _ = filepath.EvalSymlinks(dir)
+	}
+
+	git, err := bintest.CompileProxy("git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer git.Close()
+
+	out := &bytes.Buffer{}
+	logged := &bytes.Buffer{}
+
+	sh, err := shell.New(
+		shell.WithWriter(out),
+		shell.WithLogger(&shell.WriterLogger{Writer: logged, Ansi: false}),
+		shell.WithWorkingDir(dir),
+		shell.WithEnvironment(env.FromSlice(append(os.Environ(), "MY_CUSTOM_ENV=1"))),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		call := <-git.Ch
+		fmt.Fprintf(call.Stdout, "%s %s", call.Dir, call.GetEnv("MY_CUSTOM_ENV"))
+		call.Exit(0)
+	}()
+
+	if err = sh.Run(git.Path, "status"); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, dir+" 1", out.String())
+	assert.Equal(t, "$ "+git.Path+" status\n", logged.String())
+	assert.Equal(t, dir, sh.Getwd())
+}
+
+func TestNewWithMissingWorkingDir(t *testing.T) {
+	_, err := shell.New(shell.WithWorkingDir(filepath.Join(os.TempDir(), "this-does-not-exist")))
+	assert.Error(t, err)
+}
+
+func TestWithDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shelltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// macos has a symlinked temp dir
+	if runtime.GOOS == "darwin" {
+		dir, _ = filepath.EvalSymlinks(dir)
+	}
+
+	if err := os.Mkdir(filepath.Join(dir, "submodule"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	sh := newShellForTest(t)
+	if err := sh.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	git, err := bintest.CompileProxy("git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer git.Close()
+
+	go func() {
+		call := <-git.Ch
+		fmt.Fprint(call.Stdout, call.Dir)
+		call.Exit(0)
+	}()
+
+	subsh, err := sh.WithDir("submodule")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := subsh.RunAndCapture(git.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, filepath.Join(dir, "submodule"), out)
+	assert.Equal(t, dir, sh.Getwd())
+
+	if _, err := sh.WithDir("nope"); err == nil {
+		t.Fatalf("Expected an error for a directory that doesn't exist")
+	}
+}
+
 func TestRun(t *testing.T) {
 	sshKeygen, err := bintest.CompileProxy("ssh-keygen")
 	if err != nil {
@@ -106,6 +296,112 @@ func TestRun(t *testing.T) {
 	}
 }
 
+func TestRunAndTee(t *testing.T) {
+	git, err := bintest.CompileProxy("git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer git.Close()
+
+	out := &bytes.Buffer{}
+
+	sh := newShellForTest(t)
+	sh.PTY = false
+	sh.Writer = out
+	sh.Logger = &shell.WriterLogger{Writer: out, Ansi: false}
+
+	go func() {
+		call := <-git.Ch
+		fmt.Fprintln(call.Stdout, "Cloning into '.'...")
+		fmt.Fprintln(call.Stderr, "Receiving objects: 100%")
+		call.Exit(0)
+	}()
+
+	captured, err := sh.RunAndTee(git.Path, "clone")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The proxy doesn't guarantee ordering between stdout and stderr
+	for _, line := range []string{"Cloning into '.'...\n", "Receiving objects: 100%\n"} {
+		assert.Contains(t, captured, line)
+		assert.Contains(t, out.String(), line)
+	}
+	assert.Equal(t, len("Cloning into '.'...\nReceiving objects: 100%\n"), len(captured))
+	assert.True(t, strings.HasPrefix(out.String(), "$ "+git.Path+" clone\n"))
+}
+
+func TestWithQuiet(t *testing.T) {
+	sshKeyscan, err := bintest.CompileProxy("ssh-keyscan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sshKeyscan.Close()
+
+	out := &bytes.Buffer{}
+
+	sh := newShellForTest(t)
+	sh.PTY = false
+	sh.Debug = true
+	sh.Writer = out
+	sh.Logger = &shell.WriterLogger{Writer: out, Ansi: false}
+
+	go func() {
+		call := <-sshKeyscan.Ch
+		fmt.Fprintln(call.Stdout, "github.com ssh-ed25519 xxx=")
+		call.Exit(0)
+	}()
+
+	actual, err := sh.WithQuiet().RunAndCapture(sshKeyscan.Path, "github.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "github.com ssh-ed25519 xxx=", actual)
+	assert.Equal(t, "", out.String())
+
+	go func() {
+		call := <-sshKeyscan.Ch
+		fmt.Fprintln(call.Stdout, "github.com ssh-ed25519 xxx=")
+		call.Exit(0)
+	}()
+
+	// Only the copy is quiet
+	if _, err = sh.RunAndCapture(sshKeyscan.Path, "github.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Contains(t, out.String(), "$ "+sshKeyscan.Path+" github.com\n")
+}
+
+func TestWithWriters(t *testing.T) {
+	git, err := bintest.CompileProxy("git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer git.Close()
+
+	out, copied := &bytes.Buffer{}, &bytes.Buffer{}
+
+	sh := newShellForTest(t)
+	sh.PTY = false
+	sh.Writer = out
+
+	go func() {
+		call := <-git.Ch
+		fmt.Fprintln(call.Stdout, "Cloning into '.'...")
+		call.Exit(0)
+	}()
+
+	if err = sh.WithWriters(copied).Run(git.Path, "clone"); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "Cloning into '.'...\n", out.String())
+	assert.Equal(t, "Cloning into '.'...\n", copied.String())
+	assert.Equal(t, out, sh.Writer)
+}
+
 func TestRunWithStdin(t *testing.T) {
 	out := &bytes.Buffer{}
 	sh := newShellForTest(t)
@@ -120,6 +416,35 @@ func TestRunWithStdin(t *testing.T) {
 	}
 }
 
+func TestRunAndCaptureWithStdinString(t *testing.T) {
+	sshKeyscan, err := bintest.CompileProxy("ssh-keyscan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sshKeyscan.Close()
+
+	sh := newShellForTest(t)
+	sh.PTY = true
+
+	go func() {
+		call := <-sshKeyscan.Ch
+		// Reading to the end only finishes if stdin is closed
+		input, _ := ioutil.ReadAll(call.Stdin)
+		for _, host := range strings.Fields(string(input)) {
+			fmt.Fprintf(call.Stdout, "%s ssh-ed25519 xxx=\n", host)
+		}
+		call.Exit(0)
+	}()
+
+	actual, err := sh.WithStdinString("github.com\ngitlab.com\n").RunAndCapture(sshKeyscan.Path, "-f", "-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "github.com ssh-ed25519 xxx=\ngitlab.com ssh-ed25519 xxx=", actual)
+	assert.True(t, sh.PTY)
+}
+
 func TestContextCancelTerminates(t *testing.T) {
 	if runtime.GOOS == `windows` {
 		t.Skip("Not supported in windows")
@@ -155,6 +480,87 @@ func TestContextCancelTerminates(t *testing.T) {
 	}
 }
 
+func TestRunAndCaptureWithContextCancelTerminates(t *testing.T) {
+	if runtime.GOOS == `windows` {
+		t.Skip("Not supported in windows")
+	}
+
+	sleepCmd, err := bintest.CompileProxy("sleep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sleepCmd.Close()
+
+	sh, err := shell.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sh.Logger = shell.DiscardLogger
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		call := <-sleepCmd.Ch
+		cancel()
+		time.Sleep(time.Second * 60)
+		call.Exit(0)
+	}()
+
+	_, err = sh.RunAndCaptureWithContext(ctx, sleepCmd.Path)
+	if !shell.IsExitSignaled(err) {
+		t.Fatalf("Expected signal exit, got %#v", err)
+	}
+}
+
+func TestWithTimeoutKillsCommand(t *testing.T) {
+	if runtime.GOOS == `windows` {
+		t.Skip("Not supported in windows")
+	}
+
+	dir, err := ioutil.TempDir("", "shell-timeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Writes some output, then waits on a child that would outlive it
+	script := filepath.Join(dir, "hang")
+	pidFile := filepath.Join(dir, "child.pid")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\necho partial\nsleep 60 &\necho $! > "+pidFile+"\nwait\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	sh := newShellForTest(t)
+
+	start := time.Now()
+	out, stderr, err := sh.WithTimeout(500*time.Millisecond).RunAndCaptureStreams(script)
+	assert.True(t, errors.Is(err, shell.ErrTimeout), "Expected ErrTimeout, got %v", err)
+	assert.Empty(t, out)
+	assert.Empty(t, stderr)
+	assert.True(t, time.Since(start) < 30*time.Second)
+
+	// The child was killed along with the script
+	pid, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	child, err := exec.Command("ps", "-o", "stat=", "-p", strings.TrimSpace(string(pid))).Output()
+	if err == nil {
+		assert.True(t, strings.HasPrefix(strings.TrimSpace(string(child)), "Z"), "Expected child to be gone, got %q", child)
+	}
+
+	// Commands that finish in time aren't affected, and neither is the shell
+	out, err = sh.WithTimeout(30 * time.Second).RunAndCapture("echo", "llamas")
+	assert.NoError(t, err)
+	assert.Equal(t, "llamas", out)
+
+	out, err = sh.RunAndCapture("echo", "alpacas")
+	assert.NoError(t, err)
+	assert.Equal(t, "alpacas", out)
+}
+
 func TestInterrupt(t *testing.T) {
 	if runtime.GOOS == `windows` {
 		t.Skip("Not supported in windows")
@@ -301,6 +707,44 @@ func TestLockFileRetriesAndTimesOut(t *testing.T) {
 	}
 }
 
+func TestLockFileWithContextStopsWhenCancelled(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Flakey on windows")
+	}
+
+	dir, err := ioutil.TempDir("", "shelltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sh := newShellForTest(t)
+	sh.Logger = shell.DiscardLogger
+
+	lockPath := filepath.Join(dir, "my.lock")
+
+	// acquire a lock in another process
+	cmd, err := acquireLockInOtherProcess(lockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer cmd.Process.Kill()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*100, cancel)
+
+	start := time.Now()
+
+	_, err = sh.LockFileWithContext(ctx, lockPath, time.Minute)
+	if err != context.Canceled {
+		t.Fatalf("Expected Canceled error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second*5 {
+		t.Fatalf("Expected to stop waiting promptly, took %v", elapsed)
+	}
+}
+
 func acquireLockInOtherProcess(lockfile string) (*exec.Cmd, error) {
 	cmd := exec.Command(os.Args[0], "-test.run=TestAcquiringLockHelperProcess", "--", lockfile)
 	cmd.Env = []string{"GO_WANT_HELPER_PROCESS=1"}
@@ -341,6 +785,35 @@ func TestAcquiringLockHelperProcess(t *testing.T) {
 	<-c
 }
 
+func TestTraceLogsQuietCommands(t *testing.T) {
+	if runtime.GOOS == `windows` {
+		t.Skip("Not supported in windows")
+	}
+
+	out := &bytes.Buffer{}
+	sh := newShellForTest(t)
+	sh.Logger = &shell.WriterLogger{Writer: out, Ansi: false}
+	sh.Trace = true
+
+	if _, err := sh.WithQuiet().RunAndCapture("echo", "llamas"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Regexp(t, "Trace: `.*echo llamas` in \".*\" exited with status 0 after ", out.String())
+
+	out.Reset()
+	_, err := sh.WithQuiet().RunAndCapture("sh", "-c", "exit 3")
+	assert.Error(t, err)
+	assert.Regexp(t, "Trace: `.*sh -c \"exit 3\"` in \".*\" exited with status 3 after ", out.String())
+
+	// Nothing is logged without it
+	out.Reset()
+	sh.Trace = false
+	if _, err := sh.WithQuiet().RunAndCapture("echo", "llamas"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, out.String())
+}
+
 func newShellForTest(t *testing.T) *shell.Shell {
 	sh, err := shell.New()
 	if err != nil {
@@ -384,3 +857,49 @@ func TestRunWithoutPromptWithContext(t *testing.T) {
 	err = sh.RunWithoutPromptWithContext(ctx, "asdasdasdasdzxczxczxzxc")
 	assert.Error(t, err)
 }
+
+func TestLookPathUsesShellPath(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Not supported on windows")
+	}
+
+	dir, err := ioutil.TempDir("", "lookpath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	binDir := filepath.Join(dir, "vendor", "bin")
+	if err := os.MkdirAll(binDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	llamaPath := filepath.Join(binDir, "llama-tool")
+	if err := ioutil.WriteFile(llamaPath, []byte("#!/bin/sh\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	sh := newShellForTest(t)
+	if err := sh.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Not in the process PATH, so it shouldn't be found
+	if _, err := sh.LookPath("llama-tool"); err == nil {
+		t.Fatal("Expected an error looking up llama-tool")
+	}
+
+	// Relative entries are relative to the shell's working directory
+	sh.Env.Set("PATH", filepath.Join("vendor", "bin"))
+
+	path, err := sh.LookPath("llama-tool")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The temp dir may be behind a symlink (e.g. on macOS)
+	expected, _ := filepath.EvalSymlinks(llamaPath)
+	actual, _ := filepath.EvalSymlinks(path)
+	assert.Equal(t, expected, actual)
+	assert.True(t, filepath.IsAbs(path))
+}
@@ -0,0 +1,94 @@
+package shell
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// MultiWriter duplicates writes to several writers, like io.MultiWriter, except
+// that a writer failing doesn't stop the others being written to. A writer that
+// fails is skipped from then on, and Write only returns an error once they've
+// all failed.
+type MultiWriter struct {
+	mu      sync.Mutex
+	writers []*tolerantWriter
+	multi   io.Writer
+}
+
+// NewMultiWriter returns a MultiWriter that writes to each of the writers
+func NewMultiWriter(writers ...io.Writer) *MultiWriter {
+	m := &MultiWriter{}
+
+	var ws []io.Writer
+	for _, w := range writers {
+		tw := &tolerantWriter{w: w}
+		m.writers = append(m.writers, tw)
+		ws = append(ws, tw)
+	}
+
+	m.multi = io.MultiWriter(ws...)
+	return m
+}
+
+func (m *MultiWriter) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// The tolerant writers never fail, so every writer is always tried
+	_, _ = m.multi.Write(p)
+
+	if err := m.err(); err != nil && m.failed() == len(m.writers) {
+		return 0, fmt.Errorf("All writers failed, the first with: %v", err)
+	}
+
+	return len(p), nil
+}
+
+// Err returns the error from the first writer that failed, if any have
+func (m *MultiWriter) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.err()
+}
+
+func (m *MultiWriter) err() error {
+	for _, w := range m.writers {
+		if w.err != nil {
+			return w.err
+		}
+	}
+	return nil
+}
+
+func (m *MultiWriter) failed() int {
+	failed := 0
+	for _, w := range m.writers {
+		if w.err != nil {
+			failed++
+		}
+	}
+	return failed
+}
+
+// tolerantWriter records the first error from a writer, and then stops writing
+// to it, so it never fails an io.MultiWriter
+type tolerantWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (t *tolerantWriter) Write(p []byte) (int, error) {
+	if t.err != nil {
+		return len(p), nil
+	}
+
+	n, err := t.w.Write(p)
+	if err == nil && n < len(p) {
+		err = io.ErrShortWrite
+	}
+	t.err = err
+
+	return len(p), nil
+}
@@ -0,0 +1,47 @@
+package shell_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/stretchr/testify/assert"
+)
+
+type failingWriter struct {
+	writes int
+}
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	f.writes++
+	return 0, errors.New("Disk full")
+}
+
+func TestMultiWriterKeepsWritingWhenOneFails(t *testing.T) {
+	a, b := &bytes.Buffer{}, &bytes.Buffer{}
+	failing := &failingWriter{}
+
+	w := shell.NewMultiWriter(a, failing, b)
+
+	for _, line := range []string{"llamas\n", "alpacas\n"} {
+		n, err := fmt.Fprint(w, line)
+		assert.NoError(t, err)
+		assert.Equal(t, len(line), n)
+	}
+
+	assert.Equal(t, "llamas\nalpacas\n", a.String())
+	assert.Equal(t, "llamas\nalpacas\n", b.String())
+
+	// The failed writer isn't tried again
+	assert.Equal(t, 1, failing.writes)
+	assert.EqualError(t, w.Err(), "Disk full")
+}
+
+func TestMultiWriterFailsWhenAllWritersFail(t *testing.T) {
+	w := shell.NewMultiWriter(&failingWriter{}, &failingWriter{})
+
+	_, err := fmt.Fprint(w, "llamas")
+	assert.Error(t, err)
+}
@@ -2,43 +2,528 @@ package bootstrap
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/buildkite/agent/v3/bootstrap/shell"
 	"github.com/buildkite/agent/v3/retry"
+	"github.com/buildkite/shellwords"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
 )
 
 var (
 	sshKeyscanRetryInterval = 2 * time.Second
+	sshDialTimeout          = 10 * time.Second
+	sshKeyCommandTimeout    = 30 * time.Second
+
+	// How long each attempt at `ssh-keyscan` can run before it's killed, so a
+	// host that silently drops connections can't hang a checkout
+	sshKeyscanTimeout = 2 * time.Minute
 )
 
-func sshKeyScan(sh *shell.Shell, host string) (string, error) {
-	toolsDir, err := findPathToSSHTools(sh)
+// sshKeyScanConfig configures how host keys are scanned, the zero value uses
+// the defaults
+type sshKeyScanConfig struct {
+	// How many times to try `ssh-keyscan` before giving up, defaults to 3
+	Attempts int
+
+	// How long to wait before the first retry, doubling after each attempt
+	RetryInterval time.Duration
+
+	// Which types of host key to scan for, as passed to `ssh-keyscan -t`.
+	// Defaults to defaultSSHKeyTypes.
+	KeyTypes []string
+
+	// How long `ssh-keyscan` waits for a host to respond before giving up on
+	// it, passed to it with -T in whole seconds. Zero leaves ssh-keyscan's own
+	// default. Each attempt is still killed after sshKeyscanTimeout.
+	ConnectTimeout time.Duration
+
+	// A command to run instead of fetching the host key directly or with
+	// `ssh-keyscan`, for hosts that can only be reached through a proxy. %h
+	// and %p in the command are replaced with the host and port, and it
+	// should print known_hosts lines for the host.
+	Command string
+
+	// A SOCKS5 or HTTP proxy to fetch host keys through, e.g.
+	// socks5://proxy:1080. Defaults to ALL_PROXY or HTTPS_PROXY from the
+	// environment, respecting NO_PROXY.
+	Proxy string
+
+	// Whether to fetch a host key of every type when fetching them natively,
+	// rather than just the one that's negotiated, e.g. to check them against
+	// pinned fingerprints
+	AllKeyTypes bool
+
+	// A command that `ssh-keyscan` is run through, and its arguments, e.g.
+	// one that sets up a FIPS module. It's run with the path to ssh-keyscan
+	// and its arguments appended.
+	Wrapper []string
+
+	// What runs `ssh-keyscan` and Command, defaults to the shell. They're
+	// run by name, rather than the path ssh-keyscan is found at.
+	Runner Runner
+}
+
+// runner returns what runs scan commands, which is fallback unless Runner is
+// set
+func (c sshKeyScanConfig) runner(fallback Runner) Runner {
+	if c.Runner != nil {
+		return c.Runner
+	}
+	return fallback
+}
+
+// wrap returns the command and arguments to run an ssh tool with, which go
+// through Wrapper if it's set
+func (c sshKeyScanConfig) wrap(path string, args []string) (string, []string) {
+	if len(c.Wrapper) == 0 {
+		return path, args
+	}
+
+	wrapped := append([]string{}, c.Wrapper[1:]...)
+	wrapped = append(wrapped, path)
+	return c.Wrapper[0], append(wrapped, args...)
+}
+
+// parseSSHToolWrapper splits the command the ssh tools are run through into
+// its words, returning an error if it can't be found so a misconfigured
+// wrapper fails straight away rather than on the first scan
+func parseSSHToolWrapper(sh *shell.Shell, wrapper string) ([]string, error) {
+	words, err := shellwords.Split(wrapper)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to parse SSH tool wrapper %q", wrapper)
+	}
+	if len(words) == 0 {
+		return nil, nil
+	}
+
+	path, err := sh.AbsolutePath(words[0])
+	if err != nil {
+		return nil, fmt.Errorf("SSH tool wrapper %q wasn't found: %v", words[0], err)
+	}
+
+	return append([]string{path}, words[1:]...), nil
+}
+
+// defaultSSHKeyTypes are the host key types scanned for by default, which
+// leaves out the obsolete dsa
+var defaultSSHKeyTypes = []string{"ed25519", "ecdsa", "rsa"}
+
+// sshHostKeyAlgorithms maps `ssh-keyscan -t` key types to the host key
+// algorithms negotiated when fetching the key natively
+var sshHostKeyAlgorithms = map[string][]string{
+	"ed25519": {ssh.KeyAlgoED25519},
+	"ecdsa":   {ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521},
+	"rsa":     {ssh.KeyAlgoRSA},
+	"dsa":     {ssh.KeyAlgoDSA},
+}
+
+// sshKeyType returns the `ssh-keyscan -t` key type for a host key algorithm or
+// the type of a key, e.g. ecdsa for ecdsa-sha2-nistp256. Unknown algorithms
+// are returned as they are.
+func sshKeyType(algorithm string) string {
+	for keyType, algorithms := range sshHostKeyAlgorithms {
+		for _, known := range algorithms {
+			if known == algorithm {
+				return keyType
+			}
+		}
+	}
+	return algorithm
+}
+
+// parseSSHKeyTypes checks that key types, as passed to `ssh-keyscan -t`, are
+// ones that are known. Otherwise a typo would leave no host key algorithms to
+// restrict the native fetch to, and the defaults would be used instead.
+func parseSSHKeyTypes(keyTypes []string) ([]string, error) {
+	var parsed []string
+
+	for _, keyType := range keyTypes {
+		keyType = strings.ToLower(strings.TrimSpace(keyType))
+		if _, ok := sshHostKeyAlgorithms[keyType]; !ok {
+			return nil, fmt.Errorf("Unknown SSH host key type %q, expected one of ed25519, ecdsa, rsa or dsa", keyType)
+		}
+		parsed = append(parsed, keyType)
+	}
+
+	return parsed, nil
+}
+
+// The StrictHostKeyChecking policies ssh can run with, which decide how the
+// agent manages known_hosts
+const (
+	// Missing hosts are scanned and added, so ssh doesn't prompt for them.
+	// This is OpenSSH's default.
+	strictHostKeyCheckingAsk = "ask"
+
+	// Only hosts already in known_hosts are trusted, so they're never scanned
+	// and missing hosts fail the checkout
+	strictHostKeyCheckingYes = "yes"
+
+	// ssh adds new hosts itself, so they're never scanned
+	strictHostKeyCheckingAcceptNew = "accept-new"
+
+	// Host keys aren't checked, so they're never scanned
+	strictHostKeyCheckingNo = "no"
+)
+
+// parseStrictHostKeyChecking returns the StrictHostKeyChecking policy for a
+// value as ssh_config accepts it, defaulting to ask
+func parseStrictHostKeyChecking(value string) (string, error) {
+	switch policy := strings.ToLower(strings.TrimSpace(value)); policy {
+	case "", strictHostKeyCheckingAsk:
+		return strictHostKeyCheckingAsk, nil
+	case strictHostKeyCheckingYes, strictHostKeyCheckingAcceptNew:
+		return policy, nil
+	case strictHostKeyCheckingNo, "off":
+		return strictHostKeyCheckingNo, nil
+	default:
+		return "", fmt.Errorf("Unknown StrictHostKeyChecking policy %q, expected one of ask, yes, accept-new or no", value)
+	}
+}
+
+func (c sshKeyScanConfig) keyTypes() []string {
+	if len(c.KeyTypes) == 0 {
+		return defaultSSHKeyTypes
+	}
+	return c.KeyTypes
+}
+
+// errHostKeyReceived is used to abort the SSH handshake once the server has
+// presented its host key, we never need to authenticate
+var errHostKeyReceived = fmt.Errorf("host key received")
+
+// sshHostKeys returns known_hosts lines for a host. The host key is fetched
+// natively first, so no ssh tooling is needed, and `ssh-keyscan` is used as a
+// fallback if that fails. If a command is configured, it's used instead.
+func sshHostKeys(sh *shell.Shell, host string, config sshKeyScanConfig) (string, error) {
+	if config.Command != "" {
+		return sshHostKeyCommand(sh, host, config)
+	}
+
+	if config.Proxy == "" {
+		hostname, port := splitHostPort(host)
+		if port == "" {
+			port = "22"
+		}
+
+		proxyURL, err := sshProxyFromEnvironment(sh.Env, net.JoinHostPort(hostname, port))
+		if err != nil {
+			sh.Warningf("Ignoring proxy from the environment: %v", err)
+		}
+		config.Proxy = proxyURL
+	}
+
+	line, dialErr := sshDialHostKey(host, config)
+	if dialErr == nil {
+		return line, nil
+	}
+
+	sh.Commentf("Failed to fetch host key for %q (%v), falling back to ssh-keyscan", host, dialErr)
+
+	line, err := sshKeyScan(sh, host, config)
+	if errors.Is(err, ErrSSHToolsNotFound) {
+		// There's nothing to fall back to, so report why both failed
+		return "", errors.Wrapf(err, "Failed to fetch host key for %q (%v)", host, dialErr)
+	}
+
+	return line, err
+}
+
+// sshDialHostKey connects to the SSH server at host (which may include a port)
+// and returns a known_hosts line for the host key it presents, connecting
+// through the configured proxy if there is one. With AllKeyTypes, it connects
+// once for each key type and returns a line for each key the server has.
+func sshDialHostKey(host string, scanConfig sshKeyScanConfig) (string, error) {
+	var algorithms []string
+	for _, keyType := range scanConfig.keyTypes() {
+		algorithms = append(algorithms, sshHostKeyAlgorithms[keyType]...)
+	}
+
+	if !scanConfig.AllKeyTypes {
+		hostKey, err := sshDialForHostKey(sshDialAddr(host), algorithms, scanConfig.Proxy, sshDialTimeout)
+		if err != nil {
+			return "", err
+		}
+
+		return knownHostsLine(host, hostKey), nil
+	}
+
+	hostKeys, err := DialHostKeys(host, DialHostKeysOptions{
+		Algorithms: algorithms,
+		Proxy:      scanConfig.Proxy,
+	})
 	if err != nil {
 		return "", err
 	}
 
-	sshKeyScanPath := filepath.Join(toolsDir, "ssh-keyscan")
-	hostParts := strings.Split(host, ":")
+	var lines []string
+	for _, hostKey := range hostKeys {
+		lines = append(lines, knownHostsLine(host, hostKey.Key))
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// HostKey is a host key presented by an SSH server
+type HostKey struct {
+	Key ssh.PublicKey
+
+	// The key's SHA256 fingerprint, as printed by `ssh-keygen -l`
+	Fingerprint string
+}
+
+// DialHostKeysOptions configures DialHostKeys, the zero value uses the
+// defaults
+type DialHostKeysOptions struct {
+	// The host key algorithms to request, e.g. ssh.KeyAlgoED25519. Defaults
+	// to those for ed25519, ecdsa and rsa keys.
+	Algorithms []string
+
+	// How long each connection can take, defaults to 10 seconds
+	Timeout time.Duration
+
+	// A SOCKS5 or HTTP proxy to connect through, e.g. socks5://proxy:1080.
+	// Unlike a checkout, the environment isn't used.
+	Proxy string
+}
+
+// DialHostKeys connects to the SSH server at host (which may include a port)
+// and returns the host keys it presents for the requested algorithms, without
+// writing them anywhere or needing any ssh tooling. The server only presents
+// the key for the algorithm that's negotiated, so it connects once for each
+// type of key. An error is only returned if no keys are received.
+func DialHostKeys(host string, opts DialHostKeysOptions) ([]HostKey, error) {
+	algorithms := opts.Algorithms
+	if len(algorithms) == 0 {
+		for _, keyType := range defaultSSHKeyTypes {
+			algorithms = append(algorithms, sshHostKeyAlgorithms[keyType]...)
+		}
+	}
+
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = sshDialTimeout
+	}
+
+	addr := sshDialAddr(host)
+
+	var hostKeys []HostKey
+	var lastErr error
+	seen := map[string]bool{}
+
+	for _, group := range groupHostKeyAlgorithms(algorithms) {
+		key, err := sshDialForHostKey(addr, group, opts.Proxy, timeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		fingerprint := ssh.FingerprintSHA256(key)
+		if seen[fingerprint] {
+			continue
+		}
+		seen[fingerprint] = true
+
+		hostKeys = append(hostKeys, HostKey{Key: key, Fingerprint: fingerprint})
+	}
+
+	if len(hostKeys) == 0 {
+		return nil, lastErr
+	}
+
+	return hostKeys, nil
+}
+
+// groupHostKeyAlgorithms groups algorithms by the type of key they're for, in
+// the order they're first requested, so a key of each type takes a single
+// connection. Algorithms that aren't known get a connection of their own.
+func groupHostKeyAlgorithms(algorithms []string) [][]string {
+	var groups [][]string
+	index := map[string]int{}
+
+	for _, algorithm := range algorithms {
+		keyType := sshKeyType(algorithm)
+
+		if i, ok := index[keyType]; ok {
+			groups[i] = append(groups[i], algorithm)
+			continue
+		}
+
+		index[keyType] = len(groups)
+		groups = append(groups, []string{algorithm})
+	}
+
+	return groups
+}
+
+// sshDialAddr returns the address to connect to for a host, which may include
+// a port
+func sshDialAddr(host string) string {
+	hostname, port := splitHostPort(host)
+	if port == "" {
+		port = "22"
+	}
+	return net.JoinHostPort(hostname, port)
+}
+
+// sshDialForHostKey connects to the SSH server at addr and returns the host key
+// it presents for one of the algorithms, giving up after timeout
+func sshDialForHostKey(addr string, algorithms []string, proxy string, timeout time.Duration) (ssh.PublicKey, error) {
+	var hostKey ssh.PublicKey
+
+	config := &ssh.ClientConfig{
+		HostKeyAlgorithms: algorithms,
+		User:              "git",
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKey = key
+			return errHostKeyReceived
+		},
+		Timeout: timeout,
+	}
+
+	var conn net.Conn
+	var err error
+	if proxy != "" {
+		conn, err = sshProxyDial(proxy, addr, timeout)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, timeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("No host key received from %s: %v", addr, err)
+	}
+	defer conn.Close()
+
+	// The timeout in the client config only applies to connecting, so make
+	// sure a server that never completes the handshake doesn't hang us
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err == nil {
+		// Shouldn't happen given the callback always fails the handshake
+		ssh.NewClient(c, chans, reqs).Close()
+	}
+
+	if hostKey == nil {
+		return nil, fmt.Errorf("No host key received from %s: %v", addr, err)
+	}
+
+	return hostKey, nil
+}
+
+// knownHostsLine returns a known_hosts line for a host key. Unlike
+// knownhosts.Line, IPv6 literals are only bracketed when there's a port, which
+// is how OpenSSH writes them.
+func knownHostsLine(host string, key ssh.PublicKey) string {
+	return normalizeHost(host) + " " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+// sshHostKeyCommand runs a user provided command to get known_hosts lines for
+// a host, giving up after sshKeyCommandTimeout
+func sshHostKeyCommand(sh *shell.Shell, host string, config sshKeyScanConfig) (string, error) {
+	command := config.Command
+
+	args, err := shellwords.Split(command)
+	if err != nil {
+		return "", fmt.Errorf("Failed to split host key command %q: %v", command, err)
+	}
+	if len(args) == 0 {
+		return "", fmt.Errorf("Host key command is empty")
+	}
+
+	hostname, port := splitHostPort(host)
+	if port == "" {
+		port = "22"
+	}
+
+	replacer := strings.NewReplacer("%h", hostname, "%p", port, "%%", "%")
+	for i, arg := range args {
+		args[i] = replacer.Replace(arg)
+	}
+
+	output, err := config.runner(sh.WithTimeout(sshKeyCommandTimeout)).RunAndCapture(args[0], args[1:]...)
+	if errors.Is(err, shell.ErrTimeout) {
+		return "", fmt.Errorf("`%s` timed out after %v", strings.Join(args, " "), sshKeyCommandTimeout)
+	} else if err != nil {
+		return "", fmt.Errorf("`%s` failed: %v", strings.Join(args, " "), err)
+	} else if strings.TrimSpace(output) == "" {
+		return "", fmt.Errorf("`%s` returned nothing", strings.Join(args, " "))
+	}
+
+	return output, nil
+}
+
+func sshKeyScan(sh *shell.Shell, host string, config sshKeyScanConfig) (string, error) {
+	var err error
+
+	sshKeyScanPath := "ssh-keyscan"
+	if config.Runner == nil {
+		if sshKeyScanPath, err = findSSHTool(sh, "ssh-keyscan"); err != nil {
+			return "", err
+		}
+	}
+	run := config.runner(sh.WithQuiet().WithTimeout(sshKeyscanTimeout))
+
+	hostname, port := splitHostPort(host)
 	sshKeyScanOutput := ""
 
-	err = retry.Do(func(s *retry.Stats) error {
-		// `ssh-keyscan` needs `-p` when scanning a host with a port
-		var sshKeyScanCommand string
-		if len(hostParts) == 2 {
-			sshKeyScanCommand = fmt.Sprintf("ssh-keyscan -p %q %q", hostParts[1], hostParts[0])
-			sshKeyScanOutput, err = sh.RunAndCapture(sshKeyScanPath, "-p", hostParts[1], hostParts[0])
+	attempts := config.Attempts
+	if attempts <= 0 {
+		attempts = 3
+	}
+
+	interval := config.RetryInterval
+	if interval <= 0 {
+		interval = sshKeyscanRetryInterval
+	}
+
+	args := []string{"-t", strings.Join(config.keyTypes(), ",")}
+
+	// `-T` only takes whole seconds, so round up rather than down to zero
+	if config.ConnectTimeout > 0 {
+		seconds := int64((config.ConnectTimeout + time.Second - 1) / time.Second)
+		args = append(args, "-T", strconv.FormatInt(seconds, 10))
+	}
+
+	// `ssh-keyscan` needs `-p` when scanning a host with a port
+	if port != "" {
+		args = append(args, "-p", port)
+	}
+	args = append(args, hostname)
+
+	sshKeyScanCommand := "ssh-keyscan"
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-") {
+			sshKeyScanCommand += " " + arg
 		} else {
-			sshKeyScanCommand = fmt.Sprintf("ssh-keyscan %q", host)
-			sshKeyScanOutput, err = sh.RunAndCapture(sshKeyScanPath, host)
+			sshKeyScanCommand += fmt.Sprintf(" %q", arg)
 		}
+	}
 
-		if err != nil {
+	err = retry.Do(func(s *retry.Stats) error {
+		// Only stdout is used, so none of the comments ssh-keyscan writes to
+		// stderr can end up in known_hosts
+		var stderr string
+		command, commandArgs := config.wrap(sshKeyScanPath, args)
+		sshKeyScanOutput, stderr, err = run.RunAndCaptureStreams(command, commandArgs...)
+
+		if errors.Is(err, shell.ErrTimeout) {
+			keyScanError := fmt.Errorf("`%s` timed out after %v", sshKeyScanCommand, sshKeyscanTimeout)
+			sh.Warningf("%s (%s)", keyScanError, s)
+			return keyScanError
+		} else if err != nil {
 			keyScanError := fmt.Errorf("`%s` failed", sshKeyScanCommand)
+			if stderr != "" {
+				keyScanError = fmt.Errorf("`%s` failed: %s", sshKeyScanCommand, stderr)
+			}
 			sh.Warningf("%s (%s)", keyScanError, s)
 			return keyScanError
 		} else if strings.TrimSpace(sshKeyScanOutput) == "" {
@@ -53,36 +538,140 @@ func sshKeyScan(sh *shell.Shell, host string) (string, error) {
 		}
 
 		return nil
-	}, &retry.Config{Maximum: 3, Interval: sshKeyscanRetryInterval})
+	}, &retry.Config{Maximum: attempts, Interval: interval, Exponential: true})
 
 	return sshKeyScanOutput, err
 }
 
+// sshToolPaths caches where each of the ssh tools was found for each PATH, as
+// finding them on Windows means running git and probing the filesystem
+var sshToolPaths = struct {
+	sync.Mutex
+	paths map[string]string
+}{paths: map[string]string{}}
+
+// findSSHTool returns the full path to one of the ssh tools, e.g. ssh-keyscan.
+// Each tool is found independently, as they aren't always installed in the
+// same directory. The result is cached for the shell's PATH until the tool no
+// longer exists, e.g. because git was upgraded.
+//
+// BUILDKITE_SSH_KEYSCAN_PATH can be set to the ssh-keyscan binary, or the
+// directory containing it, to skip searching for it.
+func findSSHTool(sh *shell.Shell, name string) (string, error) {
+	if override, _ := sh.Env.Get(`BUILDKITE_SSH_KEYSCAN_PATH`); override != "" && name == "ssh-keyscan" {
+		dir := override
+		if info, err := os.Stat(override); err == nil && !info.IsDir() {
+			dir = filepath.Dir(override)
+		}
+
+		fileExtensions, _ := sh.Env.Get("PATHEXT")
+		found, err := shell.LookPath(name, dir, fileExtensions)
+		if err != nil {
+			return "", fmt.Errorf("BUILDKITE_SSH_KEYSCAN_PATH is set, but ssh-keyscan wasn't found at %q", override)
+		}
+
+		return found, nil
+	}
+
+	path, _ := sh.Env.Get("PATH")
+	key := path + "\x00" + name
+
+	sshToolPaths.Lock()
+	defer sshToolPaths.Unlock()
+
+	if found, ok := sshToolPaths.paths[key]; ok {
+		if _, err := os.Stat(found); err == nil {
+			return found, nil
+		}
+		delete(sshToolPaths.paths, key)
+	}
+
+	found, err := lookupSSHTool(sh, name)
+	if err != nil {
+		return "", err
+	}
+
+	sshToolPaths.paths[key] = found
+	return found, nil
+}
+
 // On Windows, there are many horrible different versions of the ssh tools. Our
 // preference is the one bundled with git for windows which is generally MinGW.
 // Often this isn't in the path, so we go looking for it specifically.
 //
 // Some more details on the relative paths at
 // https://stackoverflow.com/a/11771907
-func findPathToSSHTools(sh *shell.Shell) (string, error) {
-	sshKeyscan, err := sh.AbsolutePath("ssh-keyscan")
+func lookupSSHTool(sh *shell.Shell, name string) (string, error) {
+	found, err := sh.LookPath(name)
 	if err == nil {
-		return filepath.Dir(sshKeyscan), nil
+		return found, nil
 	}
 
+	searched := []string{"$PATH"}
+
 	if runtime.GOOS == "windows" {
-		execPath, _ := sh.RunAndCapture("git", "--exec-path")
-		if len(execPath) > 0 {
-			for _, path := range []string{
-				filepath.Join(execPath, "..", "..", "..", "usr", "bin", "ssh-keygen.exe"),
-				filepath.Join(execPath, "..", "..", "bin", "ssh-keygen.exe"),
-			} {
-				if _, err := os.Stat(path); err == nil {
-					return filepath.Dir(path), nil
-				}
+		execPath, _ := sh.WithQuiet().RunAndCapture("git", "--exec-path")
+		systemRoot, _ := sh.Env.Get("SystemRoot")
+		for _, path := range windowsSSHToolPaths(execPath, systemRoot, name) {
+			if _, err := os.Stat(path); err == nil {
+				return path, nil
 			}
+			searched = append(searched, path)
 		}
 	}
 
-	return "", fmt.Errorf("Unable to find ssh-keyscan: %v", err)
+	return "", &sshToolsNotFoundError{Tool: name, Searched: searched}
+}
+
+// ErrSSHToolsNotFound is matched by errors.Is when the ssh tools can't be
+// found, including when the error has been wrapped
+var ErrSSHToolsNotFound = errors.New("Unable to find ssh-keyscan")
+
+// sshToolsNotFoundError is returned when the ssh tools can't be found in any
+// of the places that were searched
+type sshToolsNotFoundError struct {
+	Tool     string
+	Searched []string
+}
+
+// Is makes errors.Is match ErrSSHToolsNotFound
+func (e *sshToolsNotFoundError) Is(target error) bool {
+	return target == ErrSSHToolsNotFound
+}
+
+func (e *sshToolsNotFoundError) Error() string {
+	return fmt.Sprintf("Unable to find %s, looked in %s", e.Tool, strings.Join(e.Searched, ", "))
+}
+
+// windowsSSHToolPaths returns where to look for one of the ssh tools on
+// Windows, in order of preference: the ones bundled with git for windows, then
+// the OpenSSH client that ships with Windows itself. Nothing is returned when
+// git's exec path is a POSIX one, e.g. /usr/lib/git-core under WSL, as it's not
+// a Windows layout and the tools can only be found on the PATH.
+func windowsSSHToolPaths(gitExecPath string, systemRoot string, name string) []string {
+	if isPOSIXPath(gitExecPath) {
+		return nil
+	}
+
+	var paths []string
+
+	if gitExecPath != "" {
+		paths = append(paths,
+			filepath.Join(gitExecPath, "..", "..", "..", "usr", "bin", name+".exe"),
+			filepath.Join(gitExecPath, "..", "..", "bin", name+".exe"),
+		)
+	}
+
+	if systemRoot == "" {
+		systemRoot = `C:\Windows`
+	}
+
+	return append(paths, filepath.Join(systemRoot, "System32", "OpenSSH", name+".exe"))
+}
+
+// isPOSIXPath returns whether a path is an absolute POSIX path, like /usr/bin,
+// rather than a Windows one. //server/share is a UNC path with forward
+// slashes, so it isn't one.
+func isPOSIXPath(path string) bool {
+	return strings.HasPrefix(path, "/") && !strings.HasPrefix(path, "//")
 }
@@ -0,0 +1,176 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+)
+
+// SSHCheckStep is the outcome of one step of checking the SSH setup
+type SSHCheckStep struct {
+	Name     string
+	Duration time.Duration
+
+	// Why the step failed, nil if it succeeded
+	Err error
+
+	// Whether the step wasn't run because one it depends on failed
+	Skipped bool
+}
+
+// SSHCheckResult is the outcome of checking that known_hosts can be managed
+// for a host
+type SSHCheckResult struct {
+	Host  string
+	Steps []SSHCheckStep
+}
+
+// OK returns whether every step succeeded
+func (r SSHCheckResult) OK() bool {
+	for _, step := range r.Steps {
+		if step.Err != nil || step.Skipped {
+			return false
+		}
+	}
+	return true
+}
+
+// The steps of checking the SSH setup, in the order they're run
+const (
+	SSHCheckKeyscan    = "find ssh-keyscan"
+	SSHCheckKeygen     = "find ssh-keygen"
+	SSHCheckConfig     = "parse config"
+	SSHCheckKnownHosts = "open known_hosts"
+	SSHCheckLock       = "lock known_hosts"
+	SSHCheckScan       = "scan host"
+)
+
+// CheckSSH checks that the agent can add host to known_hosts with the given
+// config, so misconfigurations show up before the first checkout. It finds the
+// ssh tools, opens known_hosts for writing, takes and releases its lock, and
+// scans the host, without writing any host keys. known_hosts is opened the way
+// a checkout would open it, which creates it if it's missing, even when dry
+// runs are configured. If it's configured to only be read, it just needs to be
+// readable and its lock isn't checked.
+func CheckSSH(ctx context.Context, conf Config, host string) (SSHCheckResult, error) {
+	sh, err := shell.NewWithContext(ctx)
+	if err != nil {
+		return SSHCheckResult{}, err
+	}
+	sh.Debug = conf.Debug
+
+	return checkSSH(sh, conf, host), nil
+}
+
+func checkSSH(sh *shell.Shell, conf Config, host string) SSHCheckResult {
+	result := SSHCheckResult{Host: host}
+
+	conf.SSHKnownHostsDryRun = false
+	b := New(conf)
+	b.shell = sh
+
+	// Runs a step unless one that it depends on failed
+	step := func(name string, dependsOn bool, f func() error) bool {
+		if !dependsOn {
+			result.Steps = append(result.Steps, SSHCheckStep{Name: name, Skipped: true})
+			return false
+		}
+		start := time.Now()
+		err := f()
+		result.Steps = append(result.Steps, SSHCheckStep{Name: name, Duration: time.Since(start), Err: err})
+		return err == nil
+	}
+
+	findTool := func(name string) func() error {
+		return func() error {
+			_, err := findSSHTool(sh, name)
+			return err
+		}
+	}
+
+	// ssh-keyscan is no use if the wrapper it's run through is missing
+	step(SSHCheckKeyscan, true, func() error {
+		if _, err := parseSSHToolWrapper(sh, conf.SSHToolWrapper); err != nil {
+			return err
+		}
+		return findTool("ssh-keyscan")()
+	})
+	step(SSHCheckKeygen, true, findTool("ssh-keygen"))
+
+	var fingerprints map[string][]string
+	var keyTypes []string
+	var certAuthorities []knownHostsCertAuthority
+	var hostKeyTypes []knownHostsKeyTypes
+
+	configured := step(SSHCheckConfig, true, func() (err error) {
+		if fingerprints, err = parseHostKeyFingerprints(conf.SSHKnownHostsFingerprints); err != nil {
+			return err
+		}
+		if keyTypes, err = parseSSHKeyTypes(conf.SSHKeyscanKeyTypes); err != nil {
+			return err
+		}
+		if certAuthorities, err = parseCertAuthorities(conf.SSHKnownHostsCertAuthority); err != nil {
+			return err
+		}
+		hostKeyTypes, err = parseHostKeyTypes(conf.SSHKeyscanHostKeyTypes)
+		return err
+	})
+
+	var kh *knownHosts
+
+	opened := step(SSHCheckKnownHosts, configured, func() (err error) {
+		if kh, err = b.findSSHKnownHosts(fingerprints, keyTypes); err != nil {
+			return err
+		}
+		kh.CertAuthorities = certAuthorities
+		kh.HostKeyTypes = hostKeyTypes
+
+		// A known_hosts file that's only read needn't be writable
+		if conf.SSHKnownHostsReadOnly {
+			f, err := os.Open(kh.Path)
+			if err != nil {
+				return fmt.Errorf("Known_hosts file %q isn't readable: %v", kh.Path, err)
+			}
+			return f.Close()
+		}
+
+		f, err := os.OpenFile(kh.Path, os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return fmt.Errorf("Known_hosts file %q isn't writable: %v", kh.Path, err)
+		}
+		return f.Close()
+	})
+
+	// Nor is its lock ever taken
+	if !conf.SSHKnownHostsReadOnly {
+		step(SSHCheckLock, opened, func() error {
+			unlock, err := kh.lock()
+			if err != nil {
+				return err
+			}
+			unlock()
+			return nil
+		})
+	}
+
+	step(SSHCheckScan, opened, func() error {
+		target := resolveGitHost(sh, host)
+
+		// Hosts signed by a certificate authority aren't scanned
+		if ca, ok := kh.certAuthorityFor(target.Name); ok {
+			sh.Commentf("Host %q is trusted through certificate authority for %q, so isn't scanned", target.Name, ca.Patterns)
+			return nil
+		}
+
+		if err := kh.scanAllowed(target.Name); err != nil {
+			return err
+		}
+		_, err := kh.scan(target)
+		return err
+	})
+
+	return result
+}
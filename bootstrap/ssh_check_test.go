@@ -0,0 +1,167 @@
+package bootstrap
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckingSSH(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Not supported in windows")
+	}
+
+	t.Parallel()
+
+	addr, _ := startTestSSHServer(t)
+
+	dir, err := ioutil.TempDir("", "ssh-check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tool := range []string{"ssh-keyscan", "ssh-keygen"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, tool), []byte("#!/bin/sh\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sh := shell.NewTestShell(t)
+	sh.Env.Set("PATH", dir)
+
+	path := filepath.Join(dir, "ssh", "known_hosts")
+
+	result := checkSSH(sh, Config{SSHKnownHostsPath: path}, addr)
+	for _, step := range result.Steps {
+		assert.NoError(t, step.Err, step.Name)
+	}
+	assert.True(t, result.OK())
+	assert.Equal(t, []string{
+		SSHCheckKeyscan, SSHCheckKeygen, SSHCheckConfig, SSHCheckKnownHosts, SSHCheckLock, SSHCheckScan,
+	}, sshCheckStepNames(result))
+
+	// Nothing was written, and the lock was released
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, string(contents))
+	_, err = os.Stat(path + ".lock")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCheckingSSHWithReadOnlyKnownHosts(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Not supported in windows")
+	}
+
+	t.Parallel()
+
+	addr, _ := startTestSSHServer(t)
+
+	dir, err := ioutil.TempDir("", "ssh-check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tool := range []string{"ssh-keyscan", "ssh-keygen"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, tool), []byte("#!/bin/sh\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sh := shell.NewTestShell(t)
+	sh.Env.Set("PATH", dir)
+
+	path := filepath.Join(dir, "known_hosts")
+	conf := Config{SSHKnownHostsPath: path, SSHKnownHostsReadOnly: true}
+
+	// It must already exist, as it's not created
+	result := checkSSH(sh, conf, addr)
+	assert.False(t, result.OK())
+
+	if err := ioutil.WriteFile(path, nil, 0400); err != nil {
+		t.Fatal(err)
+	}
+
+	result = checkSSH(sh, conf, addr)
+	for _, step := range result.Steps {
+		assert.NoError(t, step.Err, step.Name)
+	}
+	assert.True(t, result.OK())
+	assert.Equal(t, []string{
+		SSHCheckKeyscan, SSHCheckKeygen, SSHCheckConfig, SSHCheckKnownHosts, SSHCheckScan,
+	}, sshCheckStepNames(result))
+}
+
+func TestCheckingSSHSkipsStepsAfterFailures(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Not supported in windows")
+	}
+
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "ssh-check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// known_hosts can't be created under a file
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, []byte{}, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	sh := shell.NewTestShell(t)
+	sh.Env.Set("PATH", "")
+
+	result := checkSSH(sh, Config{SSHKnownHostsPath: filepath.Join(file, "known_hosts")}, "git.internal")
+	assert.False(t, result.OK())
+
+	steps := map[string]SSHCheckStep{}
+	for _, step := range result.Steps {
+		steps[step.Name] = step
+	}
+
+	assert.EqualError(t, steps[SSHCheckKeyscan].Err, "Unable to find ssh-keyscan, looked in $PATH")
+	assert.EqualError(t, steps[SSHCheckKeygen].Err, "Unable to find ssh-keygen, looked in $PATH")
+	assert.NoError(t, steps[SSHCheckConfig].Err)
+	assert.Error(t, steps[SSHCheckKnownHosts].Err)
+	assert.True(t, steps[SSHCheckLock].Skipped)
+	assert.True(t, steps[SSHCheckScan].Skipped)
+
+	// A bad config is reported too
+	result = checkSSH(sh, Config{SSHKeyscanKeyTypes: []string{"nope"}}, "git.internal")
+	for _, step := range result.Steps {
+		if step.Name == SSHCheckConfig {
+			assert.EqualError(t, step.Err, `Unknown SSH host key type "nope", expected one of ed25519, ecdsa, rsa or dsa`)
+		}
+	}
+	assert.Equal(t, []string{SSHCheckKnownHosts, SSHCheckLock, SSHCheckScan}, sshCheckSkipped(result))
+}
+
+func sshCheckStepNames(result SSHCheckResult) []string {
+	var names []string
+	for _, step := range result.Steps {
+		names = append(names, step.Name)
+	}
+	return names
+}
+
+func sshCheckSkipped(result SSHCheckResult) []string {
+	var names []string
+	for _, step := range result.Steps {
+		if step.Skipped {
+			names = append(names, step.Name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,184 @@
+package bootstrap
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/env"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// sshProxyRootCAs are the CAs trusted when connecting to an https:// proxy,
+// the system roots are used when it's nil
+var sshProxyRootCAs *x509.CertPool
+
+// sshProxyFromEnvironment returns the proxy to use to connect to the SSH
+// server at addr from ALL_PROXY or HTTPS_PROXY (in that order), or an empty
+// string if there isn't one or NO_PROXY excludes the host
+func sshProxyFromEnvironment(environ *env.Environment, addr string) (string, error) {
+	proxyURL := firstEnv(environ, "ALL_PROXY", "all_proxy", "HTTPS_PROXY", "https_proxy")
+	if proxyURL == "" {
+		return "", nil
+	}
+
+	config := &httpproxy.Config{
+		HTTPSProxy: proxyURL,
+		NoProxy:    firstEnv(environ, "NO_PROXY", "no_proxy"),
+	}
+
+	u, err := config.ProxyFunc()(&url.URL{Scheme: "https", Host: addr})
+	if err != nil {
+		return "", fmt.Errorf("Invalid proxy %q: %v", proxyURL, err)
+	} else if u == nil {
+		return "", nil
+	}
+
+	return u.String(), nil
+}
+
+func firstEnv(environ *env.Environment, keys ...string) string {
+	for _, key := range keys {
+		if v, _ := environ.Get(key); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// parseSSHProxy parses a proxy URL, which can be a socks5://, http:// or
+// https:// URL, defaulting to SOCKS5 if there's no scheme
+func parseSSHProxy(proxyURL string) (*url.URL, error) {
+	if !strings.Contains(proxyURL, "://") {
+		proxyURL = "socks5://" + proxyURL
+	}
+
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid proxy %q: %v", proxyURL, err)
+	}
+
+	var defaultPort string
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		defaultPort = "1080"
+	case "http":
+		defaultPort = "80"
+	case "https":
+		defaultPort = "443"
+	default:
+		return nil, fmt.Errorf("Unsupported proxy scheme %q, expected socks5, http or https", u.Scheme)
+	}
+
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+
+	return u, nil
+}
+
+// sshProxyDial connects to addr through a SOCKS5, HTTP or HTTPS proxy
+func sshProxyDial(proxyURL string, addr string, timeout time.Duration) (net.Conn, error) {
+	u, err := parseSSHProxy(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == "http" || u.Scheme == "https" {
+		return httpConnectDial(u, addr, timeout)
+	}
+
+	var auth *proxy.Auth
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth = &proxy.Auth{User: u.User.Username(), Password: password}
+	}
+
+	dialer, err := proxy.SOCKS5("tcp", u.Host, auth, &net.Dialer{Timeout: timeout})
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to %s via proxy %s: %v", addr, u.Host, err)
+	}
+
+	return conn, nil
+}
+
+// httpConnectDial opens a tunnel to addr through an HTTP proxy with CONNECT,
+// talking TLS to the proxy if it's an https:// one
+func httpConnectDial(u *url.URL, addr string, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", u.Host, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to proxy %s: %v", u.Host, err)
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	if u.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname(), RootCAs: sshProxyRootCAs})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("Failed to connect to proxy %s: %v", u.Host, err)
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+
+	if u.User != nil {
+		password, _ := u.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Failed to connect to %s via proxy %s: %v", addr, u.Host, err)
+	}
+
+	r := bufio.NewReader(conn)
+
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Failed to connect to %s via proxy %s: %v", addr, u.Host, err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("Failed to connect to %s via proxy %s: %s", addr, u.Host, resp.Status)
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	// The SSH server may have already sent its banner, which would be sitting
+	// in the reader's buffer
+	return &bufferedConn{Conn: conn, r: r}, nil
+}
+
+// bufferedConn is a net.Conn that reads through a bufio.Reader
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
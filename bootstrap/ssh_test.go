@@ -1,13 +1,26 @@
 package bootstrap
 
 import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/buildkite/agent/v3/bootstrap/shell"
 	"github.com/buildkite/bintest/v3"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 func init() {
@@ -24,12 +37,185 @@ func TestFindingSSHTools(t *testing.T) {
 
 	sh.Logger = shell.TestingLogger{t}
 
-	_, err = findPathToSSHTools(sh)
+	_, err = findSSHTool(sh, "ssh-keyscan")
 	if err != nil {
 		t.Fatal(err)
 	}
 }
 
+func TestFindingSSHToolsIsCachedUntilRemoved(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Not supported in windows")
+	}
+
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "ssh-tools")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	firstDir := filepath.Join(dir, "first")
+	if err := os.Mkdir(firstDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	keyScanPath := filepath.Join(dir, "ssh-keyscan")
+	if err := ioutil.WriteFile(keyScanPath, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	sh := shell.NewTestShell(t)
+	sh.Env.Set("PATH", firstDir+string(os.PathListSeparator)+dir)
+
+	found, err := findSSHTool(sh, "ssh-keyscan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, keyScanPath, found)
+
+	// The cached path is used while it exists, even once another ssh-keyscan
+	// would be found first
+	firstKeyScanPath := filepath.Join(firstDir, "ssh-keyscan")
+	if err := ioutil.WriteFile(firstKeyScanPath, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	found, err = findSSHTool(sh, "ssh-keyscan")
+	assert.NoError(t, err)
+	assert.Equal(t, keyScanPath, found)
+
+	// But is looked up again once it's gone
+	if err := os.Remove(keyScanPath); err != nil {
+		t.Fatal(err)
+	}
+	found, err = findSSHTool(sh, "ssh-keyscan")
+	assert.NoError(t, err)
+	assert.Equal(t, firstKeyScanPath, found)
+}
+
+func TestFindingSSHToolsInDifferentDirectories(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Not supported in windows")
+	}
+
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "ssh-tools")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var paths []string
+	for _, tool := range []string{"ssh-keygen", "ssh-keyscan"} {
+		path := filepath.Join(dir, tool+"-bin", tool)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, filepath.Dir(path))
+	}
+
+	sh := shell.NewTestShell(t)
+	sh.Env.Set("PATH", strings.Join(paths, string(os.PathListSeparator)))
+
+	for _, tool := range []string{"ssh-keygen", "ssh-keyscan"} {
+		found, err := findSSHTool(sh, tool)
+		assert.NoError(t, err)
+		assert.Equal(t, filepath.Join(dir, tool+"-bin", tool), found)
+	}
+}
+
+func TestFindingSSHToolsFromOverride(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Not supported in windows")
+	}
+
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "ssh-tools")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyScanPath := filepath.Join(dir, "ssh-keyscan")
+	if err := ioutil.WriteFile(keyScanPath, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	sh := shell.NewTestShell(t)
+	sh.Env.Set("PATH", "")
+
+	for _, override := range []string{dir, keyScanPath} {
+		sh.Env.Set("BUILDKITE_SSH_KEYSCAN_PATH", override)
+
+		found, err := findSSHTool(sh, "ssh-keyscan")
+		assert.NoError(t, err)
+		assert.Equal(t, keyScanPath, found)
+	}
+
+	missing := filepath.Join(dir, "nope")
+	sh.Env.Set("BUILDKITE_SSH_KEYSCAN_PATH", missing)
+
+	_, err = findSSHTool(sh, "ssh-keyscan")
+	assert.EqualError(t, err, fmt.Sprintf("BUILDKITE_SSH_KEYSCAN_PATH is set, but ssh-keyscan wasn't found at %q", missing))
+}
+
+func TestFindingMissingSSHTools(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Not supported in windows")
+	}
+
+	t.Parallel()
+
+	sh := shell.NewTestShell(t)
+	sh.Env.Set("PATH", "")
+
+	_, err := findSSHTool(sh, "ssh-keyscan")
+	if _, ok := err.(*sshToolsNotFoundError); !ok {
+		t.Fatalf("Expected a sshToolsNotFoundError, got %#v", err)
+	}
+	assert.EqualError(t, err, "Unable to find ssh-keyscan, looked in $PATH")
+
+	// The sentinel matches even once the error has been wrapped
+	assert.True(t, errors.Is(err, ErrSSHToolsNotFound))
+	assert.True(t, errors.Is(errors.Wrap(err, "Could not retrieve host key"), ErrSSHToolsNotFound))
+	assert.False(t, errors.Is(fmt.Errorf("Unable to find ssh-keyscan"), ErrSSHToolsNotFound))
+}
+
+func TestWindowsSSHToolsPaths(t *testing.T) {
+	t.Parallel()
+
+	execPath := filepath.Join("Git", "mingw64", "libexec", "git-core")
+	systemRoot := filepath.Join("C", "Windows")
+
+	assert.Equal(t, []string{
+		filepath.Join("Git", "usr", "bin", "ssh-keyscan.exe"),
+		filepath.Join("Git", "mingw64", "bin", "ssh-keyscan.exe"),
+		filepath.Join(systemRoot, "System32", "OpenSSH", "ssh-keyscan.exe"),
+	}, windowsSSHToolPaths(execPath, systemRoot, "ssh-keyscan"))
+
+	// Without git, only the Windows OpenSSH client is looked for
+	assert.Equal(t, []string{
+		filepath.Join(systemRoot, "System32", "OpenSSH", "ssh-keygen.exe"),
+	}, windowsSSHToolPaths("", systemRoot, "ssh-keygen"))
+}
+
+func TestWindowsSSHToolsPathsUnderWSL(t *testing.T) {
+	t.Parallel()
+
+	// git's exec path is a POSIX one under WSL, so there's nothing relative to
+	// it, or in the Windows directory, worth looking at
+	assert.Empty(t, windowsSSHToolPaths("/usr/lib/git-core", `C:\Windows`, "ssh-keyscan"))
+
+	// A UNC path written with forward slashes is still a Windows one
+	assert.Len(t, windowsSSHToolPaths("//server/share/Git/mingw64/libexec/git-core", `C:\Windows`, "ssh-keyscan"), 3)
+}
+
 func TestSSHKeyscanReturnsOutput(t *testing.T) {
 	t.Parallel()
 
@@ -44,11 +230,11 @@ func TestSSHKeyscanReturnsOutput(t *testing.T) {
 	sh.Env.Set("PATH", filepath.Dir(keyScan.Path))
 
 	keyScan.
-		Expect("github.com").
+		Expect("-t", "ed25519,ecdsa,rsa", "github.com").
 		AndWriteToStdout("github.com ssh-rsa xxx=").
 		AndExitWith(0)
 
-	keyScanOutput, err := sshKeyScan(sh, "github.com")
+	keyScanOutput, err := sshKeyScan(sh, "github.com", sshKeyScanConfig{})
 
 	assert.Equal(t, keyScanOutput, "github.com ssh-rsa xxx=")
 	assert.NoError(t, err)
@@ -68,16 +254,40 @@ func TestSSHKeyscanWithHostAndPortReturnsOutput(t *testing.T) {
 	sh.Env.Set("PATH", filepath.Dir(keyScan.Path))
 
 	keyScan.
-		Expect("-p", "123", "github.com").
+		Expect("-t", "ed25519,ecdsa,rsa", "-p", "123", "github.com").
 		AndWriteToStdout("github.com ssh-rsa xxx=").
 		AndExitWith(0)
 
-	keyScanOutput, err := sshKeyScan(sh, "github.com:123")
+	keyScanOutput, err := sshKeyScan(sh, "github.com:123", sshKeyScanConfig{})
 
 	assert.Equal(t, keyScanOutput, "github.com ssh-rsa xxx=")
 	assert.NoError(t, err)
 }
 
+func TestSSHKeyscanWithIPv6HostAndPortReturnsOutput(t *testing.T) {
+	t.Parallel()
+
+	sh := shell.NewTestShell(t)
+
+	keyScan, err := bintest.NewMock("ssh-keyscan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keyScan.CheckAndClose(t)
+
+	sh.Env.Set("PATH", filepath.Dir(keyScan.Path))
+
+	keyScan.
+		Expect("-t", "ed25519,ecdsa,rsa", "-p", "2222", "2001:db8::1").
+		AndWriteToStdout("[2001:db8::1]:2222 ssh-rsa xxx=").
+		AndExitWith(0)
+
+	keyScanOutput, err := sshKeyScan(sh, "[2001:db8::1]:2222", sshKeyScanConfig{})
+
+	assert.Equal(t, keyScanOutput, "[2001:db8::1]:2222 ssh-rsa xxx=")
+	assert.NoError(t, err)
+}
+
 func TestSSHKeyscanRetriesOnExit1(t *testing.T) {
 	t.Parallel()
 
@@ -92,15 +302,15 @@ func TestSSHKeyscanRetriesOnExit1(t *testing.T) {
 	sh.Env.Set("PATH", filepath.Dir(keyScan.Path))
 
 	keyScan.
-		Expect("github.com").
+		Expect("-t", "ed25519,ecdsa,rsa", "github.com").
 		AndWriteToStderr("it failed").
 		Exactly(3).
 		AndExitWith(1)
 
-	keyScanOutput, err := sshKeyScan(sh, "github.com")
+	keyScanOutput, err := sshKeyScan(sh, "github.com", sshKeyScanConfig{})
 
 	assert.Equal(t, keyScanOutput, "")
-	assert.EqualError(t, err, "`ssh-keyscan \"github.com\"` failed")
+	assert.EqualError(t, err, "`ssh-keyscan -t \"ed25519,ecdsa,rsa\" \"github.com\"` failed")
 }
 
 func TestSSHKeyscanRetriesOnBlankOutputAndExit0(t *testing.T) {
@@ -117,13 +327,339 @@ func TestSSHKeyscanRetriesOnBlankOutputAndExit0(t *testing.T) {
 	sh.Env.Set("PATH", filepath.Dir(keyScan.Path))
 
 	keyScan.
-		Expect("github.com").
+		Expect("-t", "ed25519,ecdsa,rsa", "github.com").
 		AndWriteToStdout("").
 		Exactly(3).
 		AndExitWith(0)
 
-	keyScanOutput, err := sshKeyScan(sh, "github.com")
+	keyScanOutput, err := sshKeyScan(sh, "github.com", sshKeyScanConfig{})
 
 	assert.Equal(t, keyScanOutput, "")
-	assert.EqualError(t, err, "`ssh-keyscan \"github.com\"` returned nothing")
+	assert.EqualError(t, err, "`ssh-keyscan -t \"ed25519,ecdsa,rsa\" \"github.com\"` returned nothing")
+}
+
+func TestSSHDialHostKeyReturnsKnownHostsLine(t *testing.T) {
+	t.Parallel()
+
+	addr, hostKey := startTestSSHServer(t)
+
+	line, err := sshDialHostKey(addr, sshKeyScanConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, knownhosts.Line([]string{knownhosts.Normalize(addr)}, hostKey), line)
+}
+
+func TestSSHDialHostKeyFailsWhenNothingListening(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	_, err = sshDialHostKey(addr, sshKeyScanConfig{})
+	assert.Error(t, err)
+}
+
+func TestDialHostKeysReturnsEachKeyWithItsFingerprint(t *testing.T) {
+	t.Parallel()
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edSigner, err := ssh.NewSignerFromKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecSigner, err := ssh.NewSignerFromKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := startTestSSHServerWithKeys(t, edSigner, ecSigner)
+
+	hostKeys, err := DialHostKeys(addr, DialHostKeysOptions{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []HostKey{
+		{Key: edSigner.PublicKey(), Fingerprint: ssh.FingerprintSHA256(edSigner.PublicKey())},
+		{Key: ecSigner.PublicKey(), Fingerprint: ssh.FingerprintSHA256(ecSigner.PublicKey())},
+	}, hostKeys)
+
+	// Only the requested algorithms are asked for
+	hostKeys, err = DialHostKeys(addr, DialHostKeysOptions{Algorithms: []string{ssh.KeyAlgoECDSA256}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if assert.Len(t, hostKeys, 1) {
+		assert.Equal(t, ssh.FingerprintSHA256(ecSigner.PublicKey()), hostKeys[0].Fingerprint)
+	}
+
+	// The server has no rsa key, so nothing is received
+	_, err = DialHostKeys(addr, DialHostKeysOptions{Algorithms: []string{ssh.KeyAlgoRSA}})
+	assert.Error(t, err)
+}
+
+func TestGroupingHostKeyAlgorithms(t *testing.T) {
+	t.Parallel()
+
+	groups := groupHostKeyAlgorithms([]string{
+		ssh.KeyAlgoECDSA256,
+		ssh.KeyAlgoED25519,
+		ssh.KeyAlgoECDSA384,
+		"rsa-sha2-512",
+	})
+
+	assert.Equal(t, [][]string{
+		{ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384},
+		{ssh.KeyAlgoED25519},
+		{"rsa-sha2-512"},
+	}, groups)
+}
+
+// startTestSSHServer starts an SSH server on a random local port that presents
+// a freshly generated host key and then abandons each connection
+func startTestSSHServer(t *testing.T) (string, ssh.PublicKey) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return startTestSSHServerWithKeys(t, signer), signer.PublicKey()
+}
+
+// startTestSSHServerWithKeys starts an SSH server on a random local port that
+// has several host keys, returning its address
+func startTestSSHServerWithKeys(t *testing.T, signers ...ssh.Signer) string {
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	for _, signer := range signers {
+		config.AddHostKey(signer)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _, _, _ = ssh.NewServerConn(conn, config)
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func TestSSHKeyscanRetriesConfiguredNumberOfAttempts(t *testing.T) {
+	t.Parallel()
+
+	sh := shell.NewTestShell(t)
+
+	keyScan, err := bintest.NewMock("ssh-keyscan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keyScan.CheckAndClose(t)
+
+	sh.Env.Set("PATH", filepath.Dir(keyScan.Path))
+
+	keyScan.
+		Expect("-t", "ed25519,ecdsa,rsa", "github.com").
+		AndWriteToStderr("it failed").
+		Exactly(5).
+		AndExitWith(1)
+
+	_, err = sshKeyScan(sh, "github.com", sshKeyScanConfig{Attempts: 5, RetryInterval: time.Millisecond})
+
+	assert.EqualError(t, err, "`ssh-keyscan -t \"ed25519,ecdsa,rsa\" \"github.com\"` failed")
+}
+
+func TestSSHKeyscanWithKeyTypesReturnsOutput(t *testing.T) {
+	t.Parallel()
+
+	sh := shell.NewTestShell(t)
+
+	keyScan, err := bintest.NewMock("ssh-keyscan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keyScan.CheckAndClose(t)
+
+	sh.Env.Set("PATH", filepath.Dir(keyScan.Path))
+
+	keyScan.
+		Expect("-t", "ed25519", "github.com").
+		AndWriteToStdout("github.com ssh-ed25519 xxx=").
+		AndExitWith(0)
+
+	keyScanOutput, err := sshKeyScan(sh, "github.com", sshKeyScanConfig{KeyTypes: []string{"ed25519"}})
+
+	assert.Equal(t, keyScanOutput, "github.com ssh-ed25519 xxx=")
+	assert.NoError(t, err)
+}
+
+func TestSSHKeyscanWithConnectTimeout(t *testing.T) {
+	t.Parallel()
+
+	sh := shell.NewTestShell(t)
+
+	keyScan, err := bintest.NewMock("ssh-keyscan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keyScan.CheckAndClose(t)
+
+	sh.Env.Set("PATH", filepath.Dir(keyScan.Path))
+
+	keyScan.
+		Expect("-t", "ed25519,ecdsa,rsa", "-T", "2", "github.com").
+		AndWriteToStdout("github.com ssh-ed25519 xxx=").
+		AndExitWith(0)
+
+	// Part seconds are rounded up, so the timeout is never zero
+	keyScanOutput, err := sshKeyScan(sh, "github.com", sshKeyScanConfig{ConnectTimeout: 1500 * time.Millisecond})
+
+	assert.Equal(t, keyScanOutput, "github.com ssh-ed25519 xxx=")
+	assert.NoError(t, err)
+}
+
+func TestSSHKeyscanThroughWrapper(t *testing.T) {
+	t.Parallel()
+
+	sh := shell.NewTestShell(t)
+
+	keyScan, err := bintest.NewMock("ssh-keyscan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keyScan.CheckAndClose(t)
+
+	wrapper, err := bintest.NewMock("fips-wrapper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wrapper.CheckAndClose(t)
+
+	sh.Env.Set("PATH", filepath.Dir(keyScan.Path)+string(os.PathListSeparator)+filepath.Dir(wrapper.Path))
+
+	words, err := parseSSHToolWrapper(sh, "fips-wrapper --strict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{wrapper.Path, "--strict"}, words)
+
+	// ssh-keyscan is still found, but it's the wrapper that runs it
+	keyScan.Expect().NotCalled()
+	wrapper.
+		Expect("--strict", keyScan.Path, "-t", "ed25519,ecdsa,rsa", "github.com").
+		AndWriteToStdout("github.com ssh-ed25519 xxx=").
+		AndExitWith(0)
+
+	keyScanOutput, err := sshKeyScan(sh, "github.com", sshKeyScanConfig{Wrapper: words})
+
+	assert.Equal(t, keyScanOutput, "github.com ssh-ed25519 xxx=")
+	assert.NoError(t, err)
+
+	_, err = parseSSHToolWrapper(sh, "missing-wrapper --strict")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `SSH tool wrapper "missing-wrapper" wasn't found`)
+
+	words, err = parseSSHToolWrapper(sh, "")
+	assert.NoError(t, err)
+	assert.Empty(t, words)
+}
+
+func TestParsingSSHKeyTypes(t *testing.T) {
+	t.Parallel()
+
+	keyTypes, err := parseSSHKeyTypes([]string{"ed25519", " RSA"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"ed25519", "rsa"}, keyTypes)
+
+	_, err = parseSSHKeyTypes([]string{"ed25519", "ed2519"})
+	assert.EqualError(t, err, `Unknown SSH host key type "ed2519", expected one of ed25519, ecdsa, rsa or dsa`)
+}
+
+func TestSSHDialHostKeyFailsWithoutMatchingKeyType(t *testing.T) {
+	t.Parallel()
+
+	addr, _ := startTestSSHServer(t)
+
+	_, err := sshDialHostKey(addr, sshKeyScanConfig{KeyTypes: []string{"rsa"}})
+	assert.Error(t, err)
+}
+
+func TestSSHHostKeysFromCommand(t *testing.T) {
+	t.Parallel()
+
+	sh := shell.NewTestShell(t)
+
+	hostKeyCommand, err := bintest.NewMock("fetch-host-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hostKeyCommand.CheckAndClose(t)
+
+	sh.Env.Set("PATH", filepath.Dir(hostKeyCommand.Path))
+
+	hostKeyCommand.
+		Expect("--host", "git.internal", "--port", "2222").
+		AndWriteToStdout("[git.internal]:2222 ssh-ed25519 xxx=").
+		AndExitWith(0)
+
+	output, err := sshHostKeys(sh, "git.internal:2222", sshKeyScanConfig{
+		Command: "fetch-host-key --host %h --port %p",
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "[git.internal]:2222 ssh-ed25519 xxx=", output)
+}
+
+func TestSSHHostKeysFromFailingCommand(t *testing.T) {
+	t.Parallel()
+
+	sh := shell.NewTestShell(t)
+
+	hostKeyCommand, err := bintest.NewMock("fetch-host-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hostKeyCommand.CheckAndClose(t)
+
+	sh.Env.Set("PATH", filepath.Dir(hostKeyCommand.Path))
+
+	hostKeyCommand.
+		Expect("git.internal").
+		AndExitWith(1)
+
+	_, err = sshHostKeys(sh, "git.internal", sshKeyScanConfig{Command: "fetch-host-key %h"})
+	assert.Error(t, err)
 }
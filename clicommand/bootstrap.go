@@ -54,6 +54,40 @@ type BootstrapConfig struct {
 	PullRequest                  string   `cli:"pullrequest"`
 	GitSubmodules                bool     `cli:"git-submodules"`
 	SSHKeyscan                   bool     `cli:"ssh-keyscan"`
+	SSHKnownHostsPath            string   `cli:"ssh-known-hosts-path" normalize:"filepath"`
+	SSHKnownHostsHash            bool     `cli:"ssh-known-hosts-hash"`
+	SSHKnownHostsDryRun          bool     `cli:"ssh-known-hosts-dry-run"`
+	SSHKnownHostsStrictModes     bool     `cli:"ssh-known-hosts-strict-modes"`
+	SSHKeyscanAttempts           int      `cli:"ssh-keyscan-attempts"`
+	SSHKeyscanRetryInterval      int      `cli:"ssh-keyscan-retry-interval"`
+	SSHKeyscanKeyTypes           []string `cli:"ssh-keyscan-key-types" normalize:"list"`
+	SSHKeyscanCommand            string   `cli:"ssh-keyscan-command"`
+	SSHKeyscanConcurrency        int      `cli:"ssh-keyscan-concurrency"`
+	SSHKeyscanProxy              string   `cli:"ssh-keyscan-proxy"`
+	SSHKnownHostsLockTimeout     int      `cli:"ssh-known-hosts-lock-timeout"`
+	SSHKnownHostsLockDir         string   `cli:"ssh-known-hosts-lock-dir" normalize:"filepath"`
+	SSHKnownHostsFingerprints    []string `cli:"ssh-known-hosts-fingerprints" normalize:"list"`
+	SSHKnownHostsTTL             int      `cli:"ssh-known-hosts-ttl"`
+	SSHKnownHostsAuditLog        string   `cli:"ssh-known-hosts-audit-log" normalize:"filepath"`
+	SSHKnownHostsSeed            string   `cli:"ssh-known-hosts-seed" normalize:"filepath"`
+	SSHKnownHostsLockFailFast    bool     `cli:"ssh-known-hosts-lock-fail-fast"`
+	SSHKnownHostsAllow           []string `cli:"ssh-known-hosts-allow" normalize:"list"`
+	SSHKnownHostsDeny            []string `cli:"ssh-known-hosts-deny" normalize:"list"`
+	SSHKnownHostsCertAuthority   []string `cli:"ssh-known-hosts-cert-authority" normalize:"list"`
+	SSHStrictHostKeyChecking     string   `cli:"ssh-strict-host-key-checking"`
+	SSHKnownHostsJobScoped       bool     `cli:"ssh-known-hosts-job-scoped"`
+	SSHKnownHostsVerify          bool     `cli:"ssh-known-hosts-verify"`
+	SSHKeyscanConnectTimeout     int      `cli:"ssh-keyscan-connect-timeout"`
+	SSHKnownHostsFsync           bool     `cli:"ssh-known-hosts-fsync"`
+	TraceCommands                bool     `cli:"trace-commands"`
+	SSHToolWrapper               string   `cli:"ssh-tool-wrapper"`
+	ColorMode                    string   `cli:"color-mode"`
+	SSHKeyscanHostKeyTypes       []string `cli:"ssh-keyscan-host-key-types" normalize:"list"`
+	SSHKeyscanMissingKeyTypes    bool     `cli:"ssh-keyscan-missing-key-types"`
+	SSHKnownHostsReadOnly        bool     `cli:"ssh-known-hosts-read-only"`
+	SSHKnownHostsIPs             string   `cli:"ssh-known-hosts-ips"`
+	SSHKnownHostsSystem          bool     `cli:"ssh-known-hosts-system"`
+	SSHKnownHostsWarnLines       int      `cli:"ssh-known-hosts-warn-lines"`
 	AgentName                    string   `cli:"agent" validate:"required"`
 	Queue                        string   `cli:"queue"`
 	OrganizationSlug             string   `cli:"organization" validate:"required"`
@@ -278,6 +312,188 @@ var BootstrapCommand = cli.Command{
 			Usage:  "Automatically run ssh-keyscan before checkout",
 			EnvVar: "BUILDKITE_SSH_KEYSCAN",
 		},
+		cli.IntFlag{
+			Name:   "ssh-keyscan-attempts",
+			Value:  3,
+			Usage:  "How many times to attempt ssh-keyscan before giving up",
+			EnvVar: "BUILDKITE_SSH_KEYSCAN_ATTEMPTS",
+		},
+		cli.IntFlag{
+			Name:   "ssh-keyscan-retry-interval",
+			Value:  2,
+			Usage:  "Seconds to wait before retrying ssh-keyscan, doubling after each attempt",
+			EnvVar: "BUILDKITE_SSH_KEYSCAN_RETRY_INTERVAL",
+		},
+		cli.StringSliceFlag{
+			Name:   "ssh-keyscan-key-types",
+			Value:  &cli.StringSlice{},
+			Usage:  "The types of host key to scan for, defaults to ed25519, ecdsa and rsa",
+			EnvVar: "BUILDKITE_SSH_KEYSCAN_KEY_TYPES",
+		},
+		cli.StringFlag{
+			Name:   "ssh-keyscan-command",
+			Value:  "",
+			Usage:  "A command that prints known_hosts lines for a host, used instead of ssh-keyscan. %h and %p are replaced with the host and port",
+			EnvVar: "BUILDKITE_SSH_KEYSCAN_COMMAND",
+		},
+		cli.StringFlag{
+			Name:   "ssh-keyscan-proxy",
+			Value:  "",
+			Usage:  "A SOCKS5 or HTTP proxy to fetch SSH host keys through, e.g. socks5://proxy:1080. Defaults to ALL_PROXY or HTTPS_PROXY",
+			EnvVar: "BUILDKITE_SSH_KEYSCAN_PROXY",
+		},
+		cli.IntFlag{
+			Name:   "ssh-keyscan-concurrency",
+			Value:  4,
+			Usage:  "How many hosts to scan at once when adding several to known_hosts, such as for submodules",
+			EnvVar: "BUILDKITE_SSH_KEYSCAN_CONCURRENCY",
+		},
+		cli.StringFlag{
+			Name:   "ssh-known-hosts-path",
+			Value:  "",
+			Usage:  "Path to the known_hosts file that hosts are added to, defaults to ~/.ssh/known_hosts",
+			EnvVar: "BUILDKITE_SSH_KNOWN_HOSTS_PATH",
+		},
+		cli.IntFlag{
+			Name:   "ssh-known-hosts-lock-timeout",
+			Value:  30,
+			Usage:  "Seconds to wait for the known_hosts file lock to be acquired",
+			EnvVar: "BUILDKITE_SSH_KNOWN_HOSTS_LOCK_TIMEOUT",
+		},
+		cli.StringFlag{
+			Name:   "ssh-known-hosts-lock-dir",
+			Value:  "",
+			Usage:  "A local directory to keep the known_hosts lock in, for when known_hosts is on a network filesystem such as NFS",
+			EnvVar: "BUILDKITE_SSH_KNOWN_HOSTS_LOCK_DIR",
+		},
+		cli.StringSliceFlag{
+			Name:   "ssh-known-hosts-fingerprints",
+			Value:  &cli.StringSlice{},
+			Usage:  "Expected host key fingerprints as host=SHA256:fingerprint pairs, the build fails if a scanned key doesn't match",
+			EnvVar: "BUILDKITE_SSH_KNOWN_HOSTS_FINGERPRINTS",
+		},
+		cli.IntFlag{
+			Name:   "ssh-known-hosts-ttl",
+			Value:  0,
+			Usage:  "Seconds after which hosts added to known_hosts are scanned again and their entries replaced, 0 to never refresh them",
+			EnvVar: "BUILDKITE_SSH_KNOWN_HOSTS_TTL",
+		},
+		cli.StringFlag{
+			Name:   "ssh-known-hosts-audit-log",
+			Value:  "",
+			Usage:  "A file that the host, key type and fingerprint of each host key added to known_hosts is logged to as JSON",
+			EnvVar: "BUILDKITE_SSH_KNOWN_HOSTS_AUDIT_LOG",
+		},
+		cli.StringFlag{
+			Name:   "ssh-known-hosts-seed",
+			Value:  "",
+			Usage:  "A known_hosts file whose entries are added to known_hosts instead of scanning hosts, for when they can't be reached",
+			EnvVar: "BUILDKITE_SSH_KNOWN_HOSTS_SEED",
+		},
+		cli.BoolFlag{
+			Name:   "ssh-known-hosts-lock-fail-fast",
+			Usage:  "Try the known_hosts file lock once and fail if it's held, instead of waiting up to the lock timeout for it",
+			EnvVar: "BUILDKITE_SSH_KNOWN_HOSTS_LOCK_FAIL_FAST",
+		},
+		cli.StringSliceFlag{
+			Name:   "ssh-known-hosts-allow",
+			Value:  &cli.StringSlice{},
+			Usage:  "Hosts that can be scanned and added to known_hosts, e.g. github.com or *.example.com. Scanning other hosts fails the checkout",
+			EnvVar: "BUILDKITE_SSH_KNOWN_HOSTS_ALLOW",
+		},
+		cli.StringSliceFlag{
+			Name:   "ssh-known-hosts-deny",
+			Value:  &cli.StringSlice{},
+			Usage:  "Hosts that must never be scanned and added to known_hosts, e.g. *.example.com, taking precedence over --ssh-known-hosts-allow",
+			EnvVar: "BUILDKITE_SSH_KNOWN_HOSTS_DENY",
+		},
+		cli.StringSliceFlag{
+			Name:   "ssh-known-hosts-cert-authority",
+			Value:  &cli.StringSlice{},
+			Usage:  "Certificate authorities that sign host certificates, as pattern=public key or pattern=path to a public key pairs, e.g. *.example.com=/etc/ssh/ca.pub. Matching hosts get a @cert-authority entry instead of being scanned",
+			EnvVar: "BUILDKITE_SSH_KNOWN_HOSTS_CERT_AUTHORITY",
+		},
+		cli.StringFlag{
+			Name:   "ssh-strict-host-key-checking",
+			Value:  "",
+			Usage:  "The StrictHostKeyChecking policy ssh runs with. With ask, the default, missing hosts are scanned and added to known_hosts. With yes, hosts must already be in known_hosts and are never scanned. With accept-new or no, hosts aren't scanned",
+			EnvVar: "BUILDKITE_SSH_STRICT_HOST_KEY_CHECKING",
+		},
+		cli.BoolFlag{
+			Name:   "ssh-known-hosts-job-scoped",
+			Usage:  "Add hosts to a known_hosts file that's only used for the job and removed when it finishes, instead of the shared known_hosts. ssh is pointed at it through GIT_SSH_COMMAND",
+			EnvVar: "BUILDKITE_SSH_KNOWN_HOSTS_JOB_SCOPED",
+		},
+		cli.BoolFlag{
+			Name:   "ssh-known-hosts-verify",
+			Usage:  "Scan hosts that are already in known_hosts again and fail the checkout if their keys have changed, instead of leaving git to fail to connect",
+			EnvVar: "BUILDKITE_SSH_KNOWN_HOSTS_VERIFY",
+		},
+		cli.IntFlag{
+			Name:   "ssh-keyscan-connect-timeout",
+			Value:  0,
+			Usage:  "Seconds ssh-keyscan waits for a host to respond before giving up, passed to it with -T. Defaults to ssh-keyscan's own timeout",
+			EnvVar: "BUILDKITE_SSH_KEYSCAN_CONNECT_TIMEOUT",
+		},
+		cli.BoolFlag{
+			Name:   "ssh-known-hosts-fsync",
+			Usage:  "Fsync the directory known_hosts is in after it's changed, so new entries survive the machine being terminated abruptly, at the cost of slower writes",
+			EnvVar: "BUILDKITE_SSH_KNOWN_HOSTS_FSYNC",
+		},
+		cli.StringFlag{
+			Name:   "ssh-tool-wrapper",
+			Value:  "",
+			Usage:  "A command to run ssh-keyscan through, with the path to ssh-keyscan and its arguments appended, e.g. to set up a FIPS module. It's checked for when the job starts",
+			EnvVar: "BUILDKITE_SSH_TOOL_WRAPPER",
+		},
+		cli.StringSliceFlag{
+			Name:   "ssh-keyscan-host-key-types",
+			Value:  &cli.StringSlice{},
+			Usage:  "The types of host key to scan particular hosts for, as pattern=type pairs, e.g. github.com=ed25519 or *.example.com=rsa. Give a pattern more than once for several types. Other hosts are scanned for --ssh-keyscan-key-types",
+			EnvVar: "BUILDKITE_SSH_KEYSCAN_HOST_KEY_TYPES",
+		},
+		cli.BoolFlag{
+			Name:   "ssh-keyscan-missing-key-types",
+			Usage:  "Scan hosts already in known_hosts for any of their key types that they have no entries for, and add just those keys, so a key type newly enabled on a server is picked up",
+			EnvVar: "BUILDKITE_SSH_KEYSCAN_MISSING_KEY_TYPES",
+		},
+		cli.BoolFlag{
+			Name:   "ssh-known-hosts-read-only",
+			Usage:  "Only check that hosts are in known_hosts, without ever writing to it or taking its lock, e.g. on agents that verify hosts against a file other agents maintain. The checks are best-effort, as they aren't serialized against agents writing to it",
+			EnvVar: "BUILDKITE_SSH_KNOWN_HOSTS_READ_ONLY",
+		},
+		cli.StringFlag{
+			Name:   "ssh-known-hosts-ips",
+			Value:  "",
+			Usage:  "Also record host keys for the IP addresses a host resolves to, for tooling that connects by IP. Either shared, to trust the hostname's keys for them, or scan, to scan each address and record its own keys. Off by default, as it can add many entries",
+			EnvVar: "BUILDKITE_SSH_KNOWN_HOSTS_IPS",
+		},
+		cli.BoolFlag{
+			Name:   "ssh-known-hosts-system",
+			Usage:  "Add hosts to the system-wide known_hosts, e.g. /etc/ssh/ssh_known_hosts, so every user's agents share them, falling back to the user's known_hosts if it isn't writable. Its lock is kept in --ssh-known-hosts-lock-dir, or a directory all users can write to",
+			EnvVar: "BUILDKITE_SSH_KNOWN_HOSTS_SYSTEM",
+		},
+		cli.IntFlag{
+			Name:   "ssh-known-hosts-warn-lines",
+			Value:  5000,
+			Usage:  "Warn when hosts are added to a known_hosts file with more lines than this, as something adding a new host every build slows down every check of it. 0 never warns",
+			EnvVar: "BUILDKITE_SSH_KNOWN_HOSTS_WARN_LINES",
+		},
+		cli.BoolFlag{
+			Name:   "ssh-known-hosts-hash",
+			Usage:  "Hash hostnames added to known_hosts, like OpenSSH's HashKnownHosts",
+			EnvVar: "BUILDKITE_SSH_KNOWN_HOSTS_HASH",
+		},
+		cli.BoolFlag{
+			Name:   "ssh-known-hosts-dry-run",
+			Usage:  "Log the hosts that would be scanned and added to known_hosts without scanning them or writing to the file",
+			EnvVar: "BUILDKITE_SSH_KNOWN_HOSTS_DRY_RUN",
+		},
+		cli.BoolFlag{
+			Name:   "ssh-known-hosts-strict-modes",
+			Usage:  "Remove group and other access from known_hosts and the ~/.ssh directory it's in, as ssh expects with StrictModes",
+			EnvVar: "BUILDKITE_SSH_KNOWN_HOSTS_STRICT_MODES",
+		},
 		cli.BoolTFlag{
 			Name:   "git-submodules",
 			Usage:  "Enable git submodules",
@@ -310,6 +526,17 @@ var BootstrapCommand = cli.Command{
 			Usage:  "Pattern of environment variable names containing sensitive values",
 			EnvVar: "BUILDKITE_REDACTED_VARS",
 		},
+		cli.BoolFlag{
+			Name:   "trace-commands",
+			Usage:  "Log every command the bootstrap runs, including ones it usually runs quietly, with its working directory, exit status and how long it took",
+			EnvVar: "BUILDKITE_TRACE_COMMANDS",
+		},
+		cli.StringFlag{
+			Name:   "color-mode",
+			Value:  "auto",
+			Usage:  "Whether the bootstrap's comments, warnings and errors are styled with ANSI colors: auto, always or never. Auto styles them when they're written to a terminal and NO_COLOR isn't set",
+			EnvVar: "BUILDKITE_COLOR_MODE",
+		},
 		cli.StringFlag{
 			Name:   "tracing-backend",
 			Usage:  "The name of the tracing backend to use.",
@@ -403,6 +630,40 @@ var BootstrapCommand = cli.Command{
 			PluginsEnabled:               cfg.PluginsEnabled,
 			LocalHooksEnabled:            cfg.LocalHooksEnabled,
 			SSHKeyscan:                   cfg.SSHKeyscan,
+			SSHKnownHostsPath:            cfg.SSHKnownHostsPath,
+			SSHKnownHostsHash:            cfg.SSHKnownHostsHash,
+			SSHKnownHostsDryRun:          cfg.SSHKnownHostsDryRun,
+			SSHKnownHostsStrictModes:     cfg.SSHKnownHostsStrictModes,
+			SSHKeyscanAttempts:           cfg.SSHKeyscanAttempts,
+			SSHKeyscanRetryInterval:      cfg.SSHKeyscanRetryInterval,
+			SSHKeyscanKeyTypes:           cfg.SSHKeyscanKeyTypes,
+			SSHKeyscanCommand:            cfg.SSHKeyscanCommand,
+			SSHKeyscanConcurrency:        cfg.SSHKeyscanConcurrency,
+			SSHKeyscanProxy:              cfg.SSHKeyscanProxy,
+			SSHKnownHostsLockTimeout:     cfg.SSHKnownHostsLockTimeout,
+			SSHKnownHostsLockDir:         cfg.SSHKnownHostsLockDir,
+			SSHKnownHostsFingerprints:    cfg.SSHKnownHostsFingerprints,
+			SSHKnownHostsTTL:             cfg.SSHKnownHostsTTL,
+			SSHKnownHostsAuditLog:        cfg.SSHKnownHostsAuditLog,
+			SSHKnownHostsSeed:            cfg.SSHKnownHostsSeed,
+			SSHKnownHostsLockFailFast:    cfg.SSHKnownHostsLockFailFast,
+			SSHKnownHostsAllow:           cfg.SSHKnownHostsAllow,
+			SSHKnownHostsDeny:            cfg.SSHKnownHostsDeny,
+			SSHKnownHostsCertAuthority:   cfg.SSHKnownHostsCertAuthority,
+			SSHStrictHostKeyChecking:     cfg.SSHStrictHostKeyChecking,
+			SSHKnownHostsJobScoped:       cfg.SSHKnownHostsJobScoped,
+			SSHKnownHostsVerify:          cfg.SSHKnownHostsVerify,
+			SSHKeyscanConnectTimeout:     cfg.SSHKeyscanConnectTimeout,
+			SSHKnownHostsFsync:           cfg.SSHKnownHostsFsync,
+			TraceCommands:                cfg.TraceCommands,
+			SSHToolWrapper:               cfg.SSHToolWrapper,
+			ColorMode:                    cfg.ColorMode,
+			SSHKeyscanHostKeyTypes:       cfg.SSHKeyscanHostKeyTypes,
+			SSHKeyscanMissingKeyTypes:    cfg.SSHKeyscanMissingKeyTypes,
+			SSHKnownHostsReadOnly:        cfg.SSHKnownHostsReadOnly,
+			SSHKnownHostsIPs:             cfg.SSHKnownHostsIPs,
+			SSHKnownHostsSystem:          cfg.SSHKnownHostsSystem,
+			SSHKnownHostsWarnLines:       cfg.SSHKnownHostsWarnLines,
 			Shell:                        cfg.Shell,
 			Phases:                       cfg.Phases,
 			CancelSignal:                 cancelSig,
@@ -0,0 +1,102 @@
+package clicommand
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/buildkite/agent/v3/bootstrap"
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/urfave/cli"
+)
+
+var KnownHostsDumpHelpDescription = `Usage:
+
+   buildkite-agent known-hosts-dump [host...] [options...]
+
+Description:
+
+   Prints the host keys trusted by the known_hosts file the agent uses, one per
+   line with the hosts they're trusted for and their SHA256 fingerprints, so
+   it's the same whatever format the file is in.
+
+   Hashed hostnames can't be shown as they are, so they're shown as the host
+   they're the hash of if it's one of the given hosts, or one with a pinned
+   fingerprint. Otherwise the number of hashed hostnames is shown instead.
+
+   The file is found the same way the bootstrap finds it, and is only read,
+   never created or changed.
+
+Example:
+
+   $ buildkite-agent known-hosts-dump github.com gitlab.com
+   $ buildkite-agent known-hosts-dump --ssh-known-hosts-path /etc/ssh/ssh_known_hosts`
+
+type KnownHostsDumpConfig struct {
+	SSHKnownHostsPath         string   `cli:"ssh-known-hosts-path" normalize:"filepath"`
+	SSHKnownHostsFingerprints []string `cli:"ssh-known-hosts-fingerprints" normalize:"list"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+var KnownHostsDumpCommand = cli.Command{
+	Name:        "known-hosts-dump",
+	Usage:       "Print the host keys trusted by known_hosts",
+	Description: KnownHostsDumpHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "ssh-known-hosts-path",
+			Value:  "",
+			Usage:  "Path to the known_hosts file to print, defaults to ~/.ssh/known_hosts",
+			EnvVar: "BUILDKITE_SSH_KNOWN_HOSTS_PATH",
+		},
+		cli.StringSliceFlag{
+			Name:   "ssh-known-hosts-fingerprints",
+			Value:  &cli.StringSlice{},
+			Usage:  "Expected host key fingerprints as host=SHA256:fingerprint pairs, whose hosts are matched against hashed hostnames",
+			EnvVar: "BUILDKITE_SSH_KNOWN_HOSTS_FINGERPRINTS",
+		},
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := KnownHostsDumpConfig{}
+
+		l := CreateLogger(&cfg)
+
+		// Load the configuration
+		if err := cliconfig.Load(c, l, &cfg); err != nil {
+			l.Fatal("%s", err)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		dump, err := bootstrap.DumpKnownHosts(context.Background(), bootstrap.Config{
+			Debug:                     cfg.Debug,
+			SSHKnownHostsPath:         cfg.SSHKnownHostsPath,
+			SSHKnownHostsFingerprints: cfg.SSHKnownHostsFingerprints,
+		}, c.Args())
+		if err != nil {
+			l.Fatal("Failed to read known_hosts: %v", err)
+		}
+
+		l.Info("Host keys trusted by %q", dump.Path)
+		for _, line := range dump.Malformed {
+			l.Warn("Line %d of %q isn't a valid entry", line, dump.Path)
+		}
+
+		for _, entry := range dump.Entries {
+			fmt.Println(entry)
+		}
+	},
+}
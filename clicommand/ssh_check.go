@@ -0,0 +1,235 @@
+package clicommand
+
+import (
+	"context"
+	"os"
+
+	"github.com/buildkite/agent/v3/bootstrap"
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/urfave/cli"
+)
+
+var SSHCheckHelpDescription = `Usage:
+
+   buildkite-agent ssh-check <host> [options...]
+
+Description:
+
+   Checks that the agent can add a host to known_hosts, so that problems with
+   the SSH setup show up before the first checkout rather than during it.
+
+   It finds ssh-keyscan and ssh-keygen, opens the known_hosts file for writing,
+   takes and releases its lock, and scans the host's keys without writing them.
+   With --ssh-known-hosts-read-only, known_hosts only needs to be readable and
+   its lock isn't taken. The result of each step is printed, and the command
+   exits with a status of 1 if any of them fail.
+
+   It uses the same ssh options and environment variables as the bootstrap, so
+   it can be run with the agent's environment to check its configuration.
+
+Example:
+
+   $ buildkite-agent ssh-check github.com
+   $ buildkite-agent ssh-check git.internal:2222 --ssh-known-hosts-path /etc/ssh/ssh_known_hosts`
+
+type SSHCheckConfig struct {
+	Host                       string   `cli:"arg:0" label:"host" validate:"required"`
+	SSHKeyscanAttempts         int      `cli:"ssh-keyscan-attempts"`
+	SSHKeyscanRetryInterval    int      `cli:"ssh-keyscan-retry-interval"`
+	SSHKeyscanKeyTypes         []string `cli:"ssh-keyscan-key-types" normalize:"list"`
+	SSHKeyscanHostKeyTypes     []string `cli:"ssh-keyscan-host-key-types" normalize:"list"`
+	SSHKeyscanConnectTimeout   int      `cli:"ssh-keyscan-connect-timeout"`
+	SSHKeyscanCommand          string   `cli:"ssh-keyscan-command"`
+	SSHKeyscanProxy            string   `cli:"ssh-keyscan-proxy"`
+	SSHToolWrapper             string   `cli:"ssh-tool-wrapper"`
+	SSHKnownHostsPath          string   `cli:"ssh-known-hosts-path" normalize:"filepath"`
+	SSHKnownHostsLockTimeout   int      `cli:"ssh-known-hosts-lock-timeout"`
+	SSHKnownHostsLockDir       string   `cli:"ssh-known-hosts-lock-dir" normalize:"filepath"`
+	SSHKnownHostsLockFailFast  bool     `cli:"ssh-known-hosts-lock-fail-fast"`
+	SSHKnownHostsReadOnly      bool     `cli:"ssh-known-hosts-read-only"`
+	SSHKnownHostsSystem        bool     `cli:"ssh-known-hosts-system"`
+	SSHKnownHostsFingerprints  []string `cli:"ssh-known-hosts-fingerprints" normalize:"list"`
+	SSHKnownHostsAllow         []string `cli:"ssh-known-hosts-allow" normalize:"list"`
+	SSHKnownHostsDeny          []string `cli:"ssh-known-hosts-deny" normalize:"list"`
+	SSHKnownHostsCertAuthority []string `cli:"ssh-known-hosts-cert-authority" normalize:"list"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+var SSHCheckCommand = cli.Command{
+	Name:        "ssh-check",
+	Usage:       "Check that a host can be added to known_hosts",
+	Description: SSHCheckHelpDescription,
+	Flags: []cli.Flag{
+		cli.IntFlag{
+			Name:   "ssh-keyscan-attempts",
+			Value:  3,
+			Usage:  "How many times to attempt ssh-keyscan before giving up",
+			EnvVar: "BUILDKITE_SSH_KEYSCAN_ATTEMPTS",
+		},
+		cli.IntFlag{
+			Name:   "ssh-keyscan-retry-interval",
+			Value:  2,
+			Usage:  "Seconds to wait before retrying ssh-keyscan, doubling after each attempt",
+			EnvVar: "BUILDKITE_SSH_KEYSCAN_RETRY_INTERVAL",
+		},
+		cli.StringSliceFlag{
+			Name:   "ssh-keyscan-key-types",
+			Value:  &cli.StringSlice{},
+			Usage:  "The types of host key to scan for, defaults to ed25519, ecdsa and rsa",
+			EnvVar: "BUILDKITE_SSH_KEYSCAN_KEY_TYPES",
+		},
+		cli.StringSliceFlag{
+			Name:   "ssh-keyscan-host-key-types",
+			Value:  &cli.StringSlice{},
+			Usage:  "The types of host key to scan particular hosts for, as pattern=type pairs, e.g. github.com=ed25519 or *.example.com=rsa. Give a pattern more than once for several types. Other hosts are scanned for --ssh-keyscan-key-types",
+			EnvVar: "BUILDKITE_SSH_KEYSCAN_HOST_KEY_TYPES",
+		},
+		cli.IntFlag{
+			Name:   "ssh-keyscan-connect-timeout",
+			Value:  0,
+			Usage:  "Seconds ssh-keyscan waits for a host to respond before giving up, passed to it with -T. Defaults to ssh-keyscan's own timeout",
+			EnvVar: "BUILDKITE_SSH_KEYSCAN_CONNECT_TIMEOUT",
+		},
+		cli.StringFlag{
+			Name:   "ssh-keyscan-command",
+			Value:  "",
+			Usage:  "A command that prints known_hosts lines for a host, used instead of ssh-keyscan. %h and %p are replaced with the host and port",
+			EnvVar: "BUILDKITE_SSH_KEYSCAN_COMMAND",
+		},
+		cli.StringFlag{
+			Name:   "ssh-keyscan-proxy",
+			Value:  "",
+			Usage:  "A SOCKS5 or HTTP proxy to fetch SSH host keys through, e.g. socks5://proxy:1080. Defaults to ALL_PROXY or HTTPS_PROXY",
+			EnvVar: "BUILDKITE_SSH_KEYSCAN_PROXY",
+		},
+		cli.StringFlag{
+			Name:   "ssh-tool-wrapper",
+			Value:  "",
+			Usage:  "A command to run ssh-keyscan through, with the path to ssh-keyscan and its arguments appended, e.g. to set up a FIPS module",
+			EnvVar: "BUILDKITE_SSH_TOOL_WRAPPER",
+		},
+		cli.StringFlag{
+			Name:   "ssh-known-hosts-path",
+			Value:  "",
+			Usage:  "Path to the known_hosts file that hosts are added to, defaults to ~/.ssh/known_hosts",
+			EnvVar: "BUILDKITE_SSH_KNOWN_HOSTS_PATH",
+		},
+		cli.IntFlag{
+			Name:   "ssh-known-hosts-lock-timeout",
+			Value:  30,
+			Usage:  "Seconds to wait for the known_hosts file lock to be acquired",
+			EnvVar: "BUILDKITE_SSH_KNOWN_HOSTS_LOCK_TIMEOUT",
+		},
+		cli.StringFlag{
+			Name:   "ssh-known-hosts-lock-dir",
+			Value:  "",
+			Usage:  "A local directory to keep the known_hosts lock in, for when known_hosts is on a network filesystem such as NFS",
+			EnvVar: "BUILDKITE_SSH_KNOWN_HOSTS_LOCK_DIR",
+		},
+		cli.BoolFlag{
+			Name:   "ssh-known-hosts-lock-fail-fast",
+			Usage:  "Try the known_hosts file lock once and fail if it's held, instead of waiting up to the lock timeout for it",
+			EnvVar: "BUILDKITE_SSH_KNOWN_HOSTS_LOCK_FAIL_FAST",
+		},
+		cli.BoolFlag{
+			Name:   "ssh-known-hosts-read-only",
+			Usage:  "Only check that hosts are in known_hosts, without ever writing to it or taking its lock, e.g. on agents that verify hosts against a file other agents maintain. The checks are best-effort, as they aren't serialized against agents writing to it",
+			EnvVar: "BUILDKITE_SSH_KNOWN_HOSTS_READ_ONLY",
+		},
+		cli.BoolFlag{
+			Name:   "ssh-known-hosts-system",
+			Usage:  "Add hosts to the system-wide known_hosts, e.g. /etc/ssh/ssh_known_hosts, so every user's agents share them, falling back to the user's known_hosts if it isn't writable. Its lock is kept in --ssh-known-hosts-lock-dir, or a directory all users can write to",
+			EnvVar: "BUILDKITE_SSH_KNOWN_HOSTS_SYSTEM",
+		},
+		cli.StringSliceFlag{
+			Name:   "ssh-known-hosts-fingerprints",
+			Value:  &cli.StringSlice{},
+			Usage:  "Expected host key fingerprints as host=SHA256:fingerprint pairs",
+			EnvVar: "BUILDKITE_SSH_KNOWN_HOSTS_FINGERPRINTS",
+		},
+		cli.StringSliceFlag{
+			Name:   "ssh-known-hosts-allow",
+			Value:  &cli.StringSlice{},
+			Usage:  "Hosts that can be scanned and added to known_hosts, e.g. github.com or *.example.com. Scanning other hosts fails the checkout",
+			EnvVar: "BUILDKITE_SSH_KNOWN_HOSTS_ALLOW",
+		},
+		cli.StringSliceFlag{
+			Name:   "ssh-known-hosts-deny",
+			Value:  &cli.StringSlice{},
+			Usage:  "Hosts that must never be scanned and added to known_hosts, e.g. *.example.com, taking precedence over --ssh-known-hosts-allow",
+			EnvVar: "BUILDKITE_SSH_KNOWN_HOSTS_DENY",
+		},
+		cli.StringSliceFlag{
+			Name:   "ssh-known-hosts-cert-authority",
+			Value:  &cli.StringSlice{},
+			Usage:  "Certificate authorities that sign host certificates, as pattern=public key or pattern=path to a public key pairs, e.g. *.example.com=/etc/ssh/ca.pub. Matching hosts get a @cert-authority entry instead of being scanned",
+			EnvVar: "BUILDKITE_SSH_KNOWN_HOSTS_CERT_AUTHORITY",
+		},
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := SSHCheckConfig{}
+
+		l := CreateLogger(&cfg)
+
+		// Load the configuration
+		if err := cliconfig.Load(c, l, &cfg); err != nil {
+			l.Fatal("%s", err)
+		}
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		result, err := bootstrap.CheckSSH(context.Background(), bootstrap.Config{
+			Debug:                      cfg.Debug,
+			SSHKeyscanAttempts:         cfg.SSHKeyscanAttempts,
+			SSHKeyscanRetryInterval:    cfg.SSHKeyscanRetryInterval,
+			SSHKeyscanKeyTypes:         cfg.SSHKeyscanKeyTypes,
+			SSHKeyscanHostKeyTypes:     cfg.SSHKeyscanHostKeyTypes,
+			SSHKeyscanConnectTimeout:   cfg.SSHKeyscanConnectTimeout,
+			SSHKeyscanCommand:          cfg.SSHKeyscanCommand,
+			SSHKeyscanProxy:            cfg.SSHKeyscanProxy,
+			SSHToolWrapper:             cfg.SSHToolWrapper,
+			SSHKnownHostsPath:          cfg.SSHKnownHostsPath,
+			SSHKnownHostsLockTimeout:   cfg.SSHKnownHostsLockTimeout,
+			SSHKnownHostsLockDir:       cfg.SSHKnownHostsLockDir,
+			SSHKnownHostsLockFailFast:  cfg.SSHKnownHostsLockFailFast,
+			SSHKnownHostsReadOnly:      cfg.SSHKnownHostsReadOnly,
+			SSHKnownHostsSystem:        cfg.SSHKnownHostsSystem,
+			SSHKnownHostsFingerprints:  cfg.SSHKnownHostsFingerprints,
+			SSHKnownHostsAllow:         cfg.SSHKnownHostsAllow,
+			SSHKnownHostsDeny:          cfg.SSHKnownHostsDeny,
+			SSHKnownHostsCertAuthority: cfg.SSHKnownHostsCertAuthority,
+		}, cfg.Host)
+		if err != nil {
+			l.Fatal("Failed to check ssh: %v", err)
+		}
+
+		for _, step := range result.Steps {
+			switch {
+			case step.Skipped:
+				l.Warn("%s: skipped", step.Name)
+			case step.Err != nil:
+				l.Error("%s: %v", step.Name, step.Err)
+			default:
+				l.Info("%s: ok (%v)", step.Name, step.Duration)
+			}
+		}
+
+		if !result.OK() {
+			os.Exit(1)
+		}
+	},
+}
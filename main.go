@@ -106,6 +106,8 @@ func main() {
 			},
 		},
 		clicommand.BootstrapCommand,
+		clicommand.SSHCheckCommand,
+		clicommand.KnownHostsDumpCommand,
 	}
 
 	// When no sub command is used
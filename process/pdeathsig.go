@@ -0,0 +1,11 @@
+// +build !linux
+
+package process
+
+// setupParentDeathSignal is a no-op outside of Linux. On Windows, processes are
+// already killed when the agent exits, as closing the job object they're in
+// kills them. Other platforms have no way of doing it, so a process that
+// outlives the agent has to be cleaned up by whatever restarts it.
+func (p *Process) setupParentDeathSignal() func() {
+	return func() {}
+}
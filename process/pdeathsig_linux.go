@@ -0,0 +1,23 @@
+package process
+
+import (
+	"runtime"
+	"syscall"
+)
+
+// setupParentDeathSignal has the kernel kill the process if the process that
+// started it exits first, e.g. if the agent crashes, so it can't linger holding
+// locks or connections. The kernel actually sends it when the thread that
+// started the process exits, and Go exits any thread whose goroutine exits
+// while locked to it, so the calling goroutine is locked to its thread until
+// the returned func is called, which must be once the process has exited.
+func (p *Process) setupParentDeathSignal() func() {
+	runtime.LockOSThread()
+
+	if p.command.SysProcAttr == nil {
+		p.command.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	p.command.SysProcAttr.Pdeathsig = syscall.SIGKILL
+
+	return runtime.UnlockOSThread
+}
@@ -70,6 +70,12 @@ type Config struct {
 	Dir             string
 	Context         context.Context
 	InterruptSignal Signal
+
+	// Whether the process is killed if the one that started it exits first,
+	// e.g. if the agent crashes. It's only supported on Linux, where Run keeps
+	// its goroutine locked to its thread while the process runs, and on
+	// Windows processes are always killed with the agent.
+	KillOnParentExit bool
 }
 
 // Process is an operating system level process
@@ -124,6 +130,13 @@ func (p *Process) Run() error {
 		p.setupProcessGroup()
 	}
 
+	// The process is started and waited for on this goroutine, so it's kept
+	// on the thread the process is started from until it's exited
+	if p.conf.KillOnParentExit {
+		release := p.setupParentDeathSignal()
+		defer release()
+	}
+
 	// Configure working dir and fail if it doesn't exist, otherwise
 	// we get confusing errors about fork/exec failing because the file
 	// doesn't exist
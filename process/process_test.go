@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"os/exec"
 	"os/signal"
 	"runtime"
 	"strings"
@@ -162,6 +164,124 @@ func TestProcessTerminatesWhenContextDoes(t *testing.T) {
 	assertProcessDoesntExist(t, p)
 }
 
+func TestProcessTerminatesChildProcesses(t *testing.T) {
+	if runtime.GOOS == `windows` {
+		t.Skip("Depends on inherited stdout, which isn't the case on windows")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b := &bytes.Buffer{}
+
+	p := process.New(logger.Discard, process.Config{
+		Path:    os.Args[0],
+		Env:     []string{"TEST_MAIN=tester-tree"},
+		Stdout:  b,
+		Context: ctx,
+	})
+
+	go func() {
+		<-p.Started()
+
+		time.Sleep(time.Millisecond * 100)
+		cancel()
+	}()
+
+	// The grandchild shares stdout, so Run only returns once it's gone too
+	start := time.Now()
+	if err := p.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Expected the child process to be terminated, took %v", elapsed)
+	}
+}
+
+func TestProcessIsKilledWhenItsParentExits(t *testing.T) {
+	if runtime.GOOS != `linux` {
+		t.Skip("Parent death signals are only supported on linux")
+	}
+
+	// The parent starts a child that's killed on parent exit, prints its pid
+	// and exits straight away without killing it
+	parent := exec.Command(os.Args[0])
+	parent.Env = append(os.Environ(), "TEST_MAIN=tester-orphan")
+	out, err := parent.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pid int
+	if _, err := fmt.Sscanf(string(out), "%d", &pid); err != nil {
+		t.Fatalf("Expected the child's pid, got %q: %v", out, err)
+	}
+
+	// An orphan that's been killed may not be reaped straight away, so
+	// zombies count as gone
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		if err != nil || strings.Contains(string(stat), ") Z ") {
+			return
+		}
+		if time.Now().After(deadline) {
+			if child, err := os.FindProcess(pid); err == nil {
+				_ = child.Kill()
+			}
+			t.Fatalf("Expected child %d to be killed when its parent exited", pid)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestProcessOutlivesTheThreadsOfItsParent(t *testing.T) {
+	if runtime.GOOS != `linux` {
+		t.Skip("Parent death signals are only supported on linux")
+	}
+
+	p := process.New(logger.Discard, process.Config{
+		Path:             os.Args[0],
+		Env:              []string{"TEST_MAIN=tester-sleep"},
+		KillOnParentExit: true,
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_ = p.Run()
+	}()
+	<-p.Started()
+
+	// Goroutines that exit while locked to their thread take it with them, as
+	// Go can't know what state they left it in. If the thread that started
+	// the process were one of them, the kernel would kill the process.
+	for i := 0; i < 100; i++ {
+		var threads sync.WaitGroup
+		for j := 0; j < 10; j++ {
+			threads.Add(1)
+			go func() {
+				defer threads.Done()
+				runtime.LockOSThread()
+			}()
+		}
+		threads.Wait()
+	}
+
+	select {
+	case <-p.Done():
+		t.Fatalf("Expected the process to still be running, it exited with %v", p.WaitResult())
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := p.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+}
+
 func TestProcessInterrupts(t *testing.T) {
 	if runtime.GOOS == `windows` {
 		t.Skip("Works in windows, but not in docker")
@@ -318,6 +438,31 @@ func TestMain(m *testing.M) {
 		fmt.Printf("SIG %v", <-signals)
 		os.Exit(0)
 
+	case "tester-tree":
+		child := exec.Command(os.Args[0])
+		child.Env = append(os.Environ(), "TEST_MAIN=tester-sleep")
+		child.Stdout = os.Stdout
+		if err := child.Start(); err != nil {
+			log.Fatal(err)
+		}
+		_ = child.Wait()
+		os.Exit(0)
+
+	case "tester-orphan":
+		p := process.New(logger.Discard, process.Config{
+			Path:             os.Args[0],
+			Env:              []string{"TEST_MAIN=tester-sleep"},
+			KillOnParentExit: true,
+		})
+		go func() { _ = p.Run() }()
+		<-p.Started()
+		fmt.Printf("%d\n", p.Pid())
+		os.Exit(0)
+
+	case "tester-sleep":
+		time.Sleep(time.Second * 30)
+		os.Exit(0)
+
 	case "tester-pgid":
 		pid := syscall.Getpid()
 		pgid, err := process.GetPgid(pid)
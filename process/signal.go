@@ -24,6 +24,10 @@ func (p *Process) postStart() error {
 	return nil
 }
 
+// terminateProcessGroup kills the process and everything it started, so
+// children like the ssh started by git can't outlive it holding locks or files
+// open. Processes are started as the leader of their own process group (or
+// session with a PTY), so killing the group kills the whole tree.
 func (p *Process) terminateProcessGroup() error {
 	p.logger.Debug("[Process] Sending signal SIGKILL to PGID: %d", p.pid)
 	return syscall.Kill(-p.pid, syscall.SIGKILL)
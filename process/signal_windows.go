@@ -5,6 +5,9 @@ package process
 import (
 	"errors"
 	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
 	"syscall"
 	"unsafe"
 
@@ -64,14 +67,38 @@ func (p *Process) postStart() error {
 
 	err = windows.AssignProcessToJobObject(windows.Handle(p.winJobHandle), processHandle)
 	if err != nil {
+		// Without the job, terminating falls back to killProcessTree
+		_ = windows.CloseHandle(windows.Handle(p.winJobHandle))
+		p.winJobHandle = 0
 		return err
 	}
 	return nil
 }
 
 func (p *Process) terminateProcessGroup() error {
-	p.logger.Debug("[Process] Terminating process tree by destroying job")
-	return windows.CloseHandle(windows.Handle(p.winJobHandle))
+	if p.winJobHandle != 0 {
+		p.logger.Debug("[Process] Terminating process tree by destroying job")
+		err := windows.CloseHandle(windows.Handle(p.winJobHandle))
+		if err == nil {
+			p.winJobHandle = 0
+			return nil
+		}
+		p.logger.Debug("[Process] Failed to destroy job: %v", err)
+	}
+
+	p.logger.Debug("[Process] Terminating process tree with taskkill")
+	return killProcessTree(p.pid)
+}
+
+// killProcessTree kills the process and everything it started with taskkill,
+// for when the process couldn't be put in a job object. On other platforms the
+// process group is killed instead, see terminateProcessGroup.
+func killProcessTree(pid int) error {
+	out, err := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(pid)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Failed to kill process tree %d: %v (%s)", pid, err, strings.TrimSpace(string(out)))
+	}
+	return nil
 }
 
 func (p *Process) interruptProcessGroup() error {
@@ -19,6 +19,9 @@ type Config struct {
 	Interval time.Duration
 	Forever  bool
 	Jitter   bool
+
+	// Double the interval after each failed attempt
+	Exponential bool
 }
 
 // A human readable representation often useful for debugging.
@@ -43,6 +46,24 @@ func (s *Stats) Break() {
 	s.breakNext = true
 }
 
+// permanentError wraps an error that shouldn't be retried
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+// Permanent marks an error as not worth retrying, e.g. because authentication
+// was denied. Do returns the error immediately rather than trying again.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
 func Do(callback func(*Stats) error, config *Config) error {
 	var err error
 
@@ -72,6 +93,9 @@ func Do(callback func(*Stats) error, config *Config) error {
 		// Preconfigure the interval that will be used (so that we have
 		// access to it in the callback)
 		stats.Interval = config.Interval
+		if config.Exponential {
+			stats.Interval = config.Interval << uint(stats.Attempt-1)
+		}
 		if config.Jitter {
 			stats.Interval = stats.Interval + (time.Duration(1000*random.Float32()) * time.Millisecond)
 		}
@@ -82,24 +106,30 @@ func Do(callback func(*Stats) error, config *Config) error {
 			return nil
 		}
 
+		// Permanent errors are returned as they were before being marked
+		if p, ok := err.(*permanentError); ok {
+			return p.err
+		}
+
 		// If the loop has callen stats.Break(), we should cancel out
 		// of the loop
 		if stats.breakNext {
 			return err
 		}
 
+		if !stats.Config.Forever {
+			// Should we give up? There's no point waiting if there won't
+			// be another attempt
+			if stats.Attempt >= stats.Config.Maximum {
+				break
+			}
+		}
+
 		// Bump the attempt number
 		stats.Attempt = stats.Attempt + 1
 
 		// Try the callback again after the interval
 		time.Sleep(stats.Interval)
-
-		if !stats.Config.Forever {
-			// Should we give up?
-			if stats.Attempt > stats.Config.Maximum {
-				break
-			}
-		}
 	}
 
 	return err
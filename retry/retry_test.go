@@ -0,0 +1,93 @@
+package retry
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDoWithExponentialBackoff(t *testing.T) {
+	t.Parallel()
+
+	var intervals []time.Duration
+	start := time.Now()
+
+	err := Do(func(s *Stats) error {
+		intervals = append(intervals, s.Interval)
+		return errors.New("Failed")
+	}, &Config{Maximum: 3, Interval: 10 * time.Millisecond, Exponential: true})
+
+	if err == nil || err.Error() != "Failed" {
+		t.Fatalf("Expected the last error to be returned, got %v", err)
+	}
+
+	expected := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond}
+	if len(intervals) != len(expected) {
+		t.Fatalf("Expected %d attempts, got %d", len(expected), len(intervals))
+	}
+	for i := range expected {
+		if intervals[i] != expected[i] {
+			t.Errorf("Expected attempt %d to have an interval of %v, got %v", i+1, expected[i], intervals[i])
+		}
+	}
+
+	// Only the waits between attempts are slept, not the one after the last
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("Expected to wait at least 30ms between attempts, waited %v", elapsed)
+	}
+}
+
+func TestDoWithJitter(t *testing.T) {
+	t.Parallel()
+
+	err := Do(func(s *Stats) error {
+		if s.Interval < time.Millisecond || s.Interval > time.Second+time.Millisecond {
+			t.Errorf("Expected an interval between 1ms and 1.001s, got %v", s.Interval)
+		}
+		return nil
+	}, &Config{Maximum: 1, Interval: time.Millisecond, Jitter: true})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDoStopsOnPermanentError(t *testing.T) {
+	t.Parallel()
+
+	denied := errors.New("Permission denied")
+	attempts := 0
+
+	err := Do(func(s *Stats) error {
+		attempts++
+		return Permanent(denied)
+	}, &Config{Maximum: 5, Interval: time.Second})
+
+	if err != denied {
+		t.Fatalf("Expected the unwrapped error, got %v", err)
+	}
+	if attempts != 1 {
+		t.Fatalf("Expected 1 attempt, got %d", attempts)
+	}
+}
+
+func TestDoSucceedsAfterFailures(t *testing.T) {
+	t.Parallel()
+
+	attempts := 0
+
+	err := Do(func(s *Stats) error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("Failed")
+		}
+		return nil
+	}, &Config{Maximum: 5, Interval: time.Millisecond})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 3 {
+		t.Fatalf("Expected 3 attempts, got %d", attempts)
+	}
+}